@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// assertionName returns the name of an assertion for messages
+func assertionName(a v1beta1.Assertion, i int) string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return fmt.Sprintf("assertions[%d]", i)
+}
+
+// getAssertionFailurePolicy returns the configured assertion failure policy, defaulting to Condition
+func getAssertionFailurePolicy(in *v1beta1.Input) v1beta1.AssertionFailurePolicy {
+	if in.AssertionFailurePolicy == nil || *in.AssertionFailurePolicy == "" {
+		return v1beta1.AssertionFailurePolicyCondition
+	}
+	return *in.AssertionFailurePolicy
+}
+
+// validateAssertions checks that assertions have a valid path and values to check, that
+// the query is never skipped and that the assertion failure policy is supported
+func validateAssertions(in *v1beta1.Input) error {
+	if len(in.Assertions) > 0 {
+		// A skipped query has no results to check, so the failure policy would be dropped
+		if in.SkipQueryWhenTargetHasData != nil && *in.SkipQueryWhenTargetHasData {
+			return errors.New("assertions cannot be combined with skipQueryWhenTargetHasData")
+		}
+		if in.RefreshInterval != nil {
+			return errors.New("assertions cannot be combined with refreshInterval")
+		}
+	}
+	for i, a := range in.Assertions {
+		if _, err := parsePath(a.Path); err != nil {
+			return errors.Wrapf(err, "assertion %s", assertionName(a, i))
+		}
+		if len(a.Contains) == 0 && (a.ContainsRef == nil || *a.ContainsRef == "") {
+			return errors.Errorf("assertion %s: contains or containsRef is required", assertionName(a, i))
+		}
+	}
+
+	switch policy := getAssertionFailurePolicy(in); policy {
+	case v1beta1.AssertionFailurePolicyCondition, v1beta1.AssertionFailurePolicyNotReady, v1beta1.AssertionFailurePolicyFatal:
+		return nil
+	default:
+		return errors.Errorf("unsupported assertionFailurePolicy: %s", policy)
+	}
+}
+
+// evaluateAssertions returns a message for each assertion of the input violated by the query results,
+// listing the values which were not found
+func (f *Function) evaluateAssertions(req *fnv1.RunFunctionRequest, in *v1beta1.Input, results interface{}) ([]string, error) {
+	data, err := structpb.NewValue(results)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert results data to structpb.Value")
+	}
+
+	var failures []string
+	for i, a := range in.Assertions {
+		name := assertionName(a, i)
+		selected, err := evaluatePath(data.AsInterface(), a.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "assertion %s", name)
+		}
+		values, err := pathStrings(selected)
+		if err != nil {
+			return nil, errors.Wrapf(err, "assertion %s", name)
+		}
+		expected, err := f.assertionValues(req, in, a)
+		if err != nil {
+			return nil, errors.Wrapf(err, "assertion %s", name)
+		}
+
+		var missing []string
+		for _, want := range expected {
+			if !containsFold(values, want) {
+				missing = append(missing, want)
+			}
+		}
+		if len(missing) > 0 {
+			failures = append(failures, fmt.Sprintf("%s: %s not found in %s", name, strings.Join(missing, ", "), a.Path))
+		}
+	}
+	return failures, nil
+}
+
+// assertionValues returns the values an assertion requires, from contains and containsRef
+func (f *Function) assertionValues(req *fnv1.RunFunctionRequest, in *v1beta1.Input, a v1beta1.Assertion) ([]string, error) {
+	values := append([]string{}, a.Contains...)
+	if a.ContainsRef == nil || *a.ContainsRef == "" {
+		return values, nil
+	}
+	resolved, err := f.resolveStringArrayRef(req, in, a.ContainsRef, "containsRef")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range resolved {
+		if v != nil {
+			values = append(values, *v)
+		}
+	}
+	return values, nil
+}
+
+// containsFold reports whether values contain value, ignoring case as principal names do
+func containsFold(values []*string, value string) bool {
+	for _, v := range values {
+		if v != nil && strings.EqualFold(*v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// gateReadiness sets the AssertionsSatisfied condition and applies the assertion failure policy
+// if any assertion failed. It returns false if the function should fail.
+func gateReadiness(rsp *fnv1.RunFunctionResponse, failures []string, policy v1beta1.AssertionFailurePolicy) bool {
+	if len(failures) == 0 {
+		response.ConditionTrue(rsp, "AssertionsSatisfied", "AssertionsPassed").
+			TargetCompositeAndClaim()
+		return true
+	}
+
+	message := "Assertions failed: " + strings.Join(failures, "; ")
+	response.ConditionFalse(rsp, "AssertionsSatisfied", "AssertionFailed").
+		WithMessage(message).
+		TargetCompositeAndClaim()
+
+	switch policy {
+	case v1beta1.AssertionFailurePolicyFatal:
+		response.Fatal(rsp, errors.New(message))
+		return false
+	case v1beta1.AssertionFailurePolicyNotReady:
+		if rsp.GetDesired().GetComposite() != nil {
+			rsp.Desired.Composite.Ready = fnv1.Ready_READY_FALSE
+		}
+	}
+	return true
+}
+
+// strongerAssertionFailurePolicy returns the policy with the stronger effect on the XR
+func strongerAssertionFailurePolicy(a, b v1beta1.AssertionFailurePolicy) v1beta1.AssertionFailurePolicy {
+	rank := map[v1beta1.AssertionFailurePolicy]int{
+		v1beta1.AssertionFailurePolicyCondition: 0,
+		v1beta1.AssertionFailurePolicyNotReady:  1,
+		v1beta1.AssertionFailurePolicyFatal:     2,
+	}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestAssertions(t *testing.T) {
+	var (
+		xr = `{
+			"apiVersion": "example.org/v1",
+			"kind": "XR",
+			"metadata": {"name": "cool-xr"},
+			"spec": {"admins": ["alice@example.com", "BOB@example.com"], "owners": ["carol@example.com", "dave@example.com"]}
+		}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"AssertionsPassed": {
+			reason: "The Function should set the AssertionsSatisfied condition when every required value is found, ignoring case",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"target": "status.members",
+						"assertions": [
+							{"name": "admins-are-members", "path": "[*].userPrincipalName", "containsRef": "spec.admins"}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "AssertionsSatisfied",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "AssertionsPassed",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupMembership"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"admins": ["alice@example.com", "BOB@example.com"], "owners": ["carol@example.com", "dave@example.com"]},
+								"status": {
+									"members": [
+										{"id": "alice-id", "userPrincipalName": "alice@example.com"},
+										{"id": "bob-id", "userPrincipalName": "bob@example.com"}
+									]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"NotReady": {
+			reason: "The Function should list the missing values and mark the desired XR as not ready",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"target": "status.members",
+						"assertions": [
+							{"name": "owners-are-members", "path": "[*].userPrincipalName", "contains": ["alice@example.com"], "containsRef": "spec.owners"}
+						],
+						"assertionFailurePolicy": "NotReady"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "AssertionsSatisfied",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "AssertionFailed",
+							Message: ptr.To("Assertions failed: owners-are-members: carol@example.com, dave@example.com not found in [*].userPrincipalName"),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupMembership"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"admins": ["alice@example.com", "BOB@example.com"], "owners": ["carol@example.com", "dave@example.com"]},
+								"status": {
+									"members": [
+										{"id": "alice-id", "userPrincipalName": "alice@example.com"},
+										{"id": "bob-id", "userPrincipalName": "bob@example.com"}
+									]
+								}
+							}`),
+							Ready: fnv1.Ready_READY_FALSE,
+						},
+					},
+				},
+			},
+		},
+		"Fatal": {
+			reason: "The Function should fail when an assertion fails with the Fatal policy",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"target": "status.members",
+						"assertions": [
+							{"path": "[*].userPrincipalName", "contains": ["carol@example.com"]}
+						],
+						"assertionFailurePolicy": "Fatal"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "AssertionsSatisfied",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "AssertionFailed",
+							Message: ptr.To("Assertions failed: assertions[0]: carol@example.com not found in [*].userPrincipalName"),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupMembership"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "Assertions failed: assertions[0]: carol@example.com not found in [*].userPrincipalName",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"admins": ["alice@example.com", "BOB@example.com"], "owners": ["carol@example.com", "dave@example.com"]},
+								"status": {
+									"members": [
+										{"id": "alice-id", "userPrincipalName": "alice@example.com"},
+										{"id": "bob-id", "userPrincipalName": "bob@example.com"}
+									]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"MultipleQueries": {
+			reason: "The Function should report the failed assertions of every query",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queries": [
+							{
+								"name": "admins",
+								"queryType": "GroupMembership",
+								"group": "platform-admins",
+								"target": "context.admins",
+								"assertions": [
+									{"path": "[*].userPrincipalName", "containsRef": "spec.admins"}
+								]
+							},
+							{
+								"name": "owners",
+								"queryType": "GroupMembership",
+								"group": "platform-owners",
+								"target": "context.owners",
+								"assertions": [
+									{"path": "[*].userPrincipalName", "contains": ["dave@example.com"]}
+								],
+								"assertionFailurePolicy": "NotReady"
+							}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "AssertionsSatisfied",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "AssertionFailed",
+							Message: ptr.To(`Assertions failed: query "owners": assertions[0]: dave@example.com not found in [*].userPrincipalName`),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `query "admins": QueryType: "GroupMembership"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `query "owners": QueryType: "GroupMembership"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"admins": [
+							{"id": "alice-id", "userPrincipalName": "alice@example.com"},
+							{"id": "bob-id", "userPrincipalName": "bob@example.com"}
+						],
+						"owners": [
+							{"id": "alice-id", "userPrincipalName": "alice@example.com"},
+							{"id": "bob-id", "userPrincipalName": "bob@example.com"}
+						]
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+							Ready:    fnv1.Ready_READY_FALSE,
+						},
+					},
+				},
+			},
+		},
+		"SkipQueryWhenTargetHasData": {
+			reason: "The Function should refuse assertions on a query which can be skipped, as a skipped query has no results to check",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"target": "status.members",
+						"skipQueryWhenTargetHasData": true,
+						"assertions": [
+							{"name": "admins-are-members", "path": "[*].userPrincipalName", "containsRef": "spec.admins"}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "assertions cannot be combined with skipQueryWhenTargetHasData",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"RefreshInterval": {
+			reason: "The Function should refuse assertions on a query which can be skipped, as a skipped query has no results to check",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"target": "status.members",
+						"refreshInterval": "1h",
+						"assertions": [
+							{"name": "admins-are-members", "path": "[*].userPrincipalName", "containsRef": "spec.admins"}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "assertions cannot be combined with refreshInterval",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"MissingValues": {
+			reason: "The Function should refuse an assertion without values to check",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"target": "status.members",
+						"assertions": [
+							{"name": "admins-are-members", "path": "[*].userPrincipalName"}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "assertion admins-are-members: contains or containsRef is required",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, _ *v1beta1.Input) (interface{}, error) {
+					return []interface{}{
+						map[string]interface{}{"id": "alice-id", "userPrincipalName": "alice@example.com"},
+						map[string]interface{}{"id": "bob-id", "userPrincipalName": "bob@example.com"},
+					}, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
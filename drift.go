@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// resultDiff is the difference between the data in a target and the query results
+type resultDiff struct {
+	added   []interface{}
+	removed []interface{}
+	changed []interface{}
+}
+
+// empty reports whether the diff has no differences
+func (d resultDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.changed) == 0
+}
+
+// value returns the diff as a JSON object to store in a target
+func (d resultDiff) value() map[string]interface{} {
+	list := func(values []interface{}) []interface{} {
+		if values == nil {
+			return []interface{}{}
+		}
+		return values
+	}
+	return map[string]interface{}{
+		"added":   list(d.added),
+		"removed": list(d.removed),
+		"changed": list(d.changed),
+	}
+}
+
+// validateDriftDetection checks the severity and the diff target of drift detection
+func (f *Function) validateDriftDetection(in *v1beta1.Input) error {
+	drift := in.DriftDetection
+	if drift == nil {
+		return nil
+	}
+	if drift.Severity != nil {
+		switch *drift.Severity {
+		case v1beta1.DriftSeverityNormal, v1beta1.DriftSeverityWarning:
+		default:
+			return errors.Errorf("unsupported driftDetection severity: %s", *drift.Severity)
+		}
+	}
+	if drift.Target != nil && !f.isValidTarget(*drift.Target) {
+		return errors.Errorf("Unrecognized driftDetection target field: %s", *drift.Target)
+	}
+	return nil
+}
+
+// detectDrift compares the query results with the data already in the target of the input,
+// reports the differences and stores them in the diff target, if any. Nothing is reported
+// when the target has no data yet. The results are compared before the merge strategy
+// combines them with the stored data, so entries gone from Microsoft Graph are reported.
+func (f *Function) detectDrift(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input, results interface{}) error {
+	existing := f.observedTargetData(req, in.Target)
+	if useEnvelope(in) {
+		existing = envelopeData(existing)
+	}
+	if !valueHasData(existing) {
+		return nil
+	}
+
+	current, err := shapeResults(in, results)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(in.Target, "metadata.") {
+		if current, err = metadataValue(current); err != nil {
+			return err
+		}
+	}
+
+	existingValue, err := structpb.NewValue(existing)
+	if err != nil {
+		return errors.Wrap(err, "cannot convert target data to structpb.Value")
+	}
+	diff := diffResults(existingValue.AsInterface(), current)
+
+	if target := in.DriftDetection.Target; target != nil {
+		if err := f.putTargetValue(req, rsp, *target, diff.value()); err != nil {
+			return errors.Wrap(err, "cannot store drift")
+		}
+	}
+	if diff.empty() {
+		return nil
+	}
+
+	message := fmt.Sprintf("Drift detected in %s: %d added, %d removed, %d changed", in.Target, len(diff.added), len(diff.removed), len(diff.changed))
+	f.log.Info("Drift detected", "target", in.Target, "added", len(diff.added), "removed", len(diff.removed), "changed", len(diff.changed))
+	if severity := in.DriftDetection.Severity; severity != nil && *severity == v1beta1.DriftSeverityWarning {
+		response.Warning(rsp, errors.New(message))
+		return nil
+	}
+	response.Normal(rsp, message)
+	return nil
+}
+
+// diffResults computes the results added, removed and changed between the existing data and
+// the query results. List elements are matched by object ID and object entries by key.
+func diffResults(existing, results interface{}) resultDiff {
+	existingList, existingIsList := existing.([]interface{})
+	resultsList, resultsIsList := results.([]interface{})
+	if existingIsList && resultsIsList {
+		return diffEntries(listEntries(existingList), listEntries(resultsList))
+	}
+
+	existingMap, existingIsMap := existing.(map[string]interface{})
+	resultsMap, resultsIsMap := results.(map[string]interface{})
+	if existingIsMap && resultsIsMap {
+		return diffEntries(mapEntries(existingMap), mapEntries(resultsMap))
+	}
+
+	if reflect.DeepEqual(existing, results) {
+		return resultDiff{}
+	}
+	return resultDiff{changed: []interface{}{map[string]interface{}{"from": existing, "to": results}}}
+}
+
+// diffEntry is a list element or object entry identified by its key
+type diffEntry struct {
+	key   string
+	value interface{}
+}
+
+// listEntries identifies list elements by object ID, or by their JSON encoding
+func listEntries(list []interface{}) []diffEntry {
+	entries := make([]diffEntry, 0, len(list))
+	for _, element := range list {
+		entries = append(entries, diffEntry{key: diffKey(element), value: element})
+	}
+	return entries
+}
+
+// mapEntries identifies object entries by their key, in sorted order
+func mapEntries(obj map[string]interface{}) []diffEntry {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	entries := make([]diffEntry, 0, len(obj))
+	for _, k := range keys {
+		entries = append(entries, diffEntry{key: k, value: obj[k]})
+	}
+	return entries
+}
+
+// diffKey returns the object ID of an object, or the JSON encoding of other values
+func diffKey(element interface{}) string {
+	if obj, ok := element.(map[string]interface{}); ok {
+		if id, ok := obj["id"].(string); ok {
+			return id
+		}
+	}
+	encoded, err := json.Marshal(element)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// diffEntries computes the entries added, removed and changed between existing and result entries
+func diffEntries(existing, results []diffEntry) resultDiff {
+	existingByKey := make(map[string]interface{}, len(existing))
+	for _, e := range existing {
+		existingByKey[e.key] = e.value
+	}
+	resultsByKey := make(map[string]interface{}, len(results))
+	for _, e := range results {
+		resultsByKey[e.key] = e.value
+	}
+
+	var diff resultDiff
+	for _, e := range existing {
+		if _, ok := resultsByKey[e.key]; !ok {
+			diff.removed = append(diff.removed, e.value)
+		}
+	}
+	for _, e := range results {
+		old, ok := existingByKey[e.key]
+		switch {
+		case !ok:
+			diff.added = append(diff.added, e.value)
+		case !reflect.DeepEqual(old, e.value):
+			diff.changed = append(diff.changed, changedEntry(e.key, old, e.value))
+		}
+	}
+	return diff
+}
+
+// changedEntry describes a changed entry: the changed fields of objects, or the old and new value
+func changedEntry(key string, old, current interface{}) map[string]interface{} {
+	oldObj, oldIsObj := old.(map[string]interface{})
+	currentObj, currentIsObj := current.(map[string]interface{})
+	if !oldIsObj || !currentIsObj {
+		return map[string]interface{}{"key": key, "from": old, "to": current}
+	}
+
+	changes := make(map[string]interface{})
+	for field, value := range currentObj {
+		if !reflect.DeepEqual(oldObj[field], value) {
+			changes[field] = map[string]interface{}{"from": oldObj[field], "to": value}
+		}
+	}
+	for field, value := range oldObj {
+		if _, ok := currentObj[field]; !ok {
+			changes[field] = map[string]interface{}{"from": value, "to": nil}
+		}
+	}
+	return map[string]interface{}{"key": key, "changes": changes}
+}
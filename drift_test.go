@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestDiffResults(t *testing.T) {
+	type args struct {
+		existing interface{}
+		results  interface{}
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   map[string]interface{}
+	}{
+		"NoDrift": {
+			reason: "Equal results should have no differences",
+			args: args{
+				existing: []interface{}{"id-1", "id-2"},
+				results:  []interface{}{"id-1", "id-2"},
+			},
+			want: map[string]interface{}{
+				"added":   []interface{}{},
+				"removed": []interface{}{},
+				"changed": []interface{}{},
+			},
+		},
+		"Members": {
+			reason: "List elements should be matched by object ID, reporting the changed fields of objects",
+			args: args{
+				existing: []interface{}{
+					map[string]interface{}{"id": "id-1", "displayName": "Devs", "mail": "dev@example.com"},
+					map[string]interface{}{"id": "id-2", "displayName": "Legacy"},
+				},
+				results: []interface{}{
+					map[string]interface{}{"id": "id-1", "displayName": "Developers"},
+					map[string]interface{}{"id": "id-3", "displayName": "Operations"},
+				},
+			},
+			want: map[string]interface{}{
+				"added": []interface{}{
+					map[string]interface{}{"id": "id-3", "displayName": "Operations"},
+				},
+				"removed": []interface{}{
+					map[string]interface{}{"id": "id-2", "displayName": "Legacy"},
+				},
+				"changed": []interface{}{
+					map[string]interface{}{
+						"key": "id-1",
+						"changes": map[string]interface{}{
+							"displayName": map[string]interface{}{"from": "Devs", "to": "Developers"},
+							"mail":        map[string]interface{}{"from": "dev@example.com", "to": nil},
+						},
+					},
+				},
+			},
+		},
+		"Map": {
+			reason: "Object entries should be matched by key",
+			args: args{
+				existing: map[string]interface{}{"alice": "id-1", "bob": "id-2"},
+				results:  map[string]interface{}{"alice": "id-4", "carol": "id-3"},
+			},
+			want: map[string]interface{}{
+				"added":   []interface{}{"id-3"},
+				"removed": []interface{}{"id-2"},
+				"changed": []interface{}{
+					map[string]interface{}{"key": "alice", "from": "id-1", "to": "id-4"},
+				},
+			},
+		},
+		"Scalar": {
+			reason: "A changed scalar should be reported with its old and new value",
+			args: args{
+				existing: "id-1",
+				results:  "id-2",
+			},
+			want: map[string]interface{}{
+				"added":   []interface{}{},
+				"removed": []interface{}{},
+				"changed": []interface{}{
+					map[string]interface{}{"from": "id-1", "to": "id-2"},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := diffResults(tc.args.existing, tc.args.results).value()
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\ndiffResults(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestDriftDetection(t *testing.T) {
+	var (
+		xr    = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Drift": {
+			reason: "The Function should report drift from the XR status and store the diff",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers", "Operations"],
+						"target": "status.groups",
+						"driftDetection": {
+							"severity": "Warning",
+							"target": "status.groupsDrift"
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"status": {
+									"groups": [
+										{"id": "Developers-id", "displayName": "Devs"},
+										{"id": "Legacy-id", "displayName": "Legacy"}
+									]
+								}
+							}`),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "Drift detected in status.groups: 1 added, 1 removed, 1 changed",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"status": {
+									"groups": [
+										{"id": "Developers-id", "displayName": "Developers"},
+										{"id": "Operations-id", "displayName": "Operations"}
+									],
+									"groupsDrift": {
+										"added": [{"id": "Operations-id", "displayName": "Operations"}],
+										"removed": [{"id": "Legacy-id", "displayName": "Legacy"}],
+										"changed": [{
+											"key": "Developers-id",
+											"changes": {"displayName": {"from": "Devs", "to": "Developers"}}
+										}]
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"NoDrift": {
+			reason: "The Function should not report drift when the results equal the data in the target",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"transform": "[*].id",
+						"target": "context.groupIDs",
+						"driftDetection": {}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Context: resource.MustStructJSON(`{"groupIDs": ["Developers-id"]}`),
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{"groupIDs": ["Developers-id"]}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"DriftInContext": {
+			reason: "The Function should report drift from the context with Normal results by default",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"transform": "[*].id",
+						"target": "context.groupIDs",
+						"driftDetection": {}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Context: resource.MustStructJSON(`{"groupIDs": ["Legacy-id"]}`),
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "Drift detected in context.groupIDs: 1 added, 1 removed, 0 changed",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{"groupIDs": ["Developers-id"]}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"DriftBeforeMerge": {
+			reason: "The Function should report drift from the query results before the merge strategy combines them with the data in the target",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"transform": "[*].id",
+						"target": "context.groupIDs",
+						"mergeStrategy": "union",
+						"driftDetection": {}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Context: resource.MustStructJSON(`{"groupIDs": ["Legacy-id"]}`),
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "Drift detected in context.groupIDs: 1 added, 1 removed, 0 changed",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{"groupIDs": ["Legacy-id", "Developers-id"]}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"UnsupportedSeverity": {
+			reason: "The Function should refuse an unsupported drift severity",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "status.groups",
+						"driftDetection": {"severity": "Fatal"}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "unsupported driftDetection severity: Fatal",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
+					results := make([]interface{}, 0, len(in.Groups))
+					for _, group := range in.Groups {
+						results = append(results, map[string]interface{}{
+							"id":          *group + "-id",
+							"displayName": *group,
+						})
+					}
+					return results, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+)
+
+// useEnvelope returns whether query results are stored in an envelope
+func useEnvelope(in *v1beta1.Input) bool {
+	return in.Envelope != nil && *in.Envelope
+}
+
+// validateEnvelope checks that the envelope is only used with status and context targets
+// and that maxAge is only used with the envelope
+func validateEnvelope(in *v1beta1.Input) error {
+	if !useEnvelope(in) {
+		if in.MaxAge != nil {
+			return errors.New("maxAge requires envelope")
+		}
+		return nil
+	}
+
+	for _, t := range resultTargets(in) {
+		if !strings.HasPrefix(t.Target, "status.") && !strings.HasPrefix(t.Target, "context.") {
+			return errors.Errorf("envelope is only supported for status and context targets, got %s", t.Target)
+		}
+	}
+	return nil
+}
+
+// storedResults returns the value stored in a status or context target: the query results
+// merged with the existing data of the target and, if enabled, wrapped in an envelope
+func (f *Function) storedResults(req *fnv1.RunFunctionRequest, in *v1beta1.Input, existing, results interface{}) (interface{}, error) {
+	if !useEnvelope(in) {
+		return mergeResults(in, existing, results)
+	}
+
+	merged, err := mergeResults(in, envelopeData(existing), results)
+	if err != nil {
+		return nil, err
+	}
+	return f.wrapEnvelope(req, in, merged)
+}
+
+// wrapEnvelope wraps query results with when and how they were fetched
+func (f *Function) wrapEnvelope(req *fnv1.RunFunctionRequest, in *v1beta1.Input, data interface{}) (map[string]interface{}, error) {
+	hash, err := resultHash(data)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := map[string]interface{}{
+		"data":       data,
+		"fetchedAt":  f.now().UTC().Format(time.RFC3339),
+		"changedAt":  f.changedAt(req, in, hash),
+		"queryType":  in.QueryType,
+		"resultHash": hash,
+		"apiVersion": GraphAPIVersion,
+	}
+
+	// Tenant fan-out queries record the tenant ID of every tenant by tenant name
+	if len(in.Tenants) > 0 {
+		tenantIDs := make(map[string]interface{}, len(in.Tenants))
+		for _, tenant := range in.Tenants {
+			if tenantID := tenantIDOf(req, in, tenant); tenantID != "" {
+				tenantIDs[tenant.Name] = tenantID
+			}
+		}
+		envelope["tenantIds"] = tenantIDs
+		return envelope, nil
+	}
+
+	if creds, err := getCreds(req, in.Identity); err == nil && creds[TenantID] != "" {
+		envelope["tenantId"] = creds[TenantID]
+	}
+	return envelope, nil
+}
+
+// changedAt returns when the results with the given hash last changed: the changedAt of the
+// stored envelope while its resultHash is unchanged, or the current time
+func (f *Function) changedAt(req *fnv1.RunFunctionRequest, in *v1beta1.Input, hash string) string {
+	stored, ok := f.observedTargetData(req, in.Target).(map[string]interface{})
+	if ok && stored["resultHash"] == hash {
+		if changedAt, ok := stored["changedAt"].(string); ok && changedAt != "" {
+			return changedAt
+		}
+	}
+	return f.now().UTC().Format(time.RFC3339)
+}
+
+// tenantIDOf returns the tenant ID a tenant of a fan-out query is queried with, if known
+func tenantIDOf(req *fnv1.RunFunctionRequest, in *v1beta1.Input, tenant v1beta1.Tenant) string {
+	if tenant.TenantID != nil && *tenant.TenantID != "" {
+		return *tenant.TenantID
+	}
+	creds, err := getCreds(req, tenantIdentity(in, tenant))
+	if err != nil {
+		return ""
+	}
+	return creds[TenantID]
+}
+
+// resultHash returns the SHA-256 hash of the JSON encoding of the query results
+func resultHash(data interface{}) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot serialize results to JSON")
+	}
+	sum := sha256.Sum256(encoded)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// envelopeData returns the data of an envelope, or nil if the value is not an envelope
+func envelopeData(value interface{}) interface{} {
+	envelope, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return envelope["data"]
+}
+
+// targetIsFresh checks if the envelope in a target was fetched less than the maxAge of the input ago
+func (f *Function) targetIsFresh(req *fnv1.RunFunctionRequest, in *v1beta1.Input, target string) bool {
+	envelope, ok := f.observedTargetData(req, target).(map[string]interface{})
+	if !ok {
+		return false
+	}
+	fetchedAt, ok := envelope["fetchedAt"].(string)
+	if !ok {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, fetchedAt)
+	if err != nil {
+		return false
+	}
+	return f.now().Sub(t) < in.MaxAge.Duration
+}
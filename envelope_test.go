@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestEnvelope(t *testing.T) {
+	var (
+		now   = time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+		xr    = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"EnvelopeInStatus": {
+			reason: "The Function should store the results in the XR status along with when and how they were fetched",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "status.groups",
+						"envelope": true
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"count": 2},
+								"status": {
+									"groups": {
+										"data": [{"id": "Developers-id", "displayName": "Developers"}],
+										"fetchedAt": "2026-01-02T15:00:00Z",
+										"changedAt": "2026-01-02T15:00:00Z",
+										"queryType": "GroupObjectIDs",
+										"tenantId": "test-tenant-id",
+										"resultHash": "sha256:7b18d1f907b15acac5e4228702992b18d968305d9d48277e4b7c9f610aea5eae",
+										"apiVersion": "v1.0"
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"UnchangedResultsKeepChangedAt": {
+			reason: "The Function should update the fetch time but keep the change time of the stored envelope when the results are unchanged",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "status.groups",
+						"envelope": true
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"count": 2},
+								"status": {
+									"groups": {
+										"data": [{"id": "Developers-id", "displayName": "Developers"}],
+										"fetchedAt": "2026-01-02T13:00:00Z",
+										"changedAt": "2026-01-02T13:00:00Z",
+										"queryType": "GroupObjectIDs",
+										"tenantId": "test-tenant-id",
+										"resultHash": "sha256:7b18d1f907b15acac5e4228702992b18d968305d9d48277e4b7c9f610aea5eae",
+										"apiVersion": "v1.0"
+									}
+								}
+							}`),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"count": 2},
+								"status": {
+									"groups": {
+										"data": [{"id": "Developers-id", "displayName": "Developers"}],
+										"fetchedAt": "2026-01-02T15:00:00Z",
+										"changedAt": "2026-01-02T13:00:00Z",
+										"queryType": "GroupObjectIDs",
+										"tenantId": "test-tenant-id",
+										"resultHash": "sha256:7b18d1f907b15acac5e4228702992b18d968305d9d48277e4b7c9f610aea5eae",
+										"apiVersion": "v1.0"
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"MergeIntoEnvelopeInContext": {
+			reason: "The Function should merge the results with the data of the envelope in the context",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Operations"],
+						"target": "context.groups",
+						"mergeStrategy": "union",
+						"envelope": true
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"groups": {
+							"data": [{"id": "Developers-id", "displayName": "Developers"}],
+							"fetchedAt": "2026-01-02T14:00:00Z",
+							"queryType": "GroupObjectIDs",
+							"tenantId": "test-tenant-id",
+							"resultHash": "sha256:7b18d1f907b15acac5e4228702992b18d968305d9d48277e4b7c9f610aea5eae",
+							"apiVersion": "v1.0"
+						}
+					}`),
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"groups": {
+							"data": [
+								{"id": "Developers-id", "displayName": "Developers"},
+								{"id": "Operations-id", "displayName": "Operations"}
+							],
+							"fetchedAt": "2026-01-02T15:00:00Z",
+							"changedAt": "2026-01-02T15:00:00Z",
+							"queryType": "GroupObjectIDs",
+							"tenantId": "test-tenant-id",
+							"resultHash": "sha256:28b3d89c403f004e40426d0e64467164ca3c5e4b15c14cf3306e79ca51c9aa99",
+							"apiVersion": "v1.0"
+						}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"SkipWithinMaxAge": {
+			reason: "The Function should skip the query when the target data was fetched less than maxAge ago",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "context.groups",
+						"envelope": true,
+						"skipQueryWhenTargetHasData": true,
+						"maxAge": "1h"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"groups": {
+							"data": [{"id": "existing-id"}],
+							"fetchedAt": "2026-01-02T14:30:00Z"
+						}
+					}`),
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSkip",
+							Status:  fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason:  "SkippedQuery",
+							Message: ptr.To("Target already has data, skipped query to avoid throttling"),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"groups": {
+							"data": [{"id": "existing-id"}],
+							"fetchedAt": "2026-01-02T14:30:00Z"
+						}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"QueryAfterMaxAge": {
+			reason: "The Function should query when the target data was fetched more than maxAge ago",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "context.groups",
+						"envelope": true,
+						"skipQueryWhenTargetHasData": true,
+						"maxAge": "1h"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"groups": {
+							"data": [{"id": "existing-id"}],
+							"fetchedAt": "2026-01-02T13:00:00Z"
+						}
+					}`),
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"groups": {
+							"data": [{"id": "Developers-id", "displayName": "Developers"}],
+							"fetchedAt": "2026-01-02T15:00:00Z",
+							"changedAt": "2026-01-02T15:00:00Z",
+							"queryType": "GroupObjectIDs",
+							"tenantId": "test-tenant-id",
+							"resultHash": "sha256:7b18d1f907b15acac5e4228702992b18d968305d9d48277e4b7c9f610aea5eae",
+							"apiVersion": "v1.0"
+						}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"MaxAgeWithoutEnvelope": {
+			reason: "The Function should refuse maxAge without envelope, as there is no fetchedAt to compare against",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "context.groups",
+						"skipQueryWhenTargetHasData": true,
+						"maxAge": "1h"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "maxAge requires envelope",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
+					results := make([]interface{}, 0, len(in.Groups))
+					for _, group := range in.Groups {
+						results = append(results, map[string]interface{}{
+							"id":          *group + "-id",
+							"displayName": *group,
+						})
+					}
+					return results, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+				clock:      func() time.Time { return now },
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
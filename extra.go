@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// extraResourceRefPrefix is the prefix of references resolved from extra resources
+const extraResourceRefPrefix = "extraResource."
+
+// validateExtraResources checks that extra resources have unique names and a valid selector
+func validateExtraResources(in *v1beta1.Input) error {
+	seen := make(map[string]bool, len(in.ExtraResources))
+	for i, extra := range in.ExtraResources {
+		if extra.Name == "" {
+			return errors.Errorf("extraResources[%d]: name is required", i)
+		}
+		if strings.Contains(extra.Name, ".") {
+			return errors.Errorf("extraResources[%d]: name %s must not contain dots", i, extra.Name)
+		}
+		if seen[extra.Name] {
+			return errors.Errorf("extraResources[%d]: duplicate name %s", i, extra.Name)
+		}
+		seen[extra.Name] = true
+
+		if extra.APIVersion == "" || extra.Kind == "" {
+			return errors.Errorf("extraResources[%d]: apiVersion and kind are required", i)
+		}
+		hasName := extra.MatchName != nil && *extra.MatchName != ""
+		if hasName == (len(extra.MatchLabels) > 0) {
+			return errors.Errorf("extraResources[%d]: exactly one of matchName or matchLabels is required", i)
+		}
+	}
+	return nil
+}
+
+// requireExtraResources asks Crossplane for the extra resources of the input. Crossplane runs
+// the function again with the requested resources, until the requirements no longer change.
+func requireExtraResources(rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) {
+	if len(in.ExtraResources) == 0 {
+		return
+	}
+
+	selectors := make(map[string]*fnv1.ResourceSelector, len(in.ExtraResources))
+	for _, extra := range in.ExtraResources {
+		selector := &fnv1.ResourceSelector{ApiVersion: extra.APIVersion, Kind: extra.Kind}
+		if extra.MatchName != nil && *extra.MatchName != "" {
+			selector.Match = &fnv1.ResourceSelector_MatchName{MatchName: *extra.MatchName}
+		} else {
+			selector.Match = &fnv1.ResourceSelector_MatchLabels{MatchLabels: &fnv1.MatchLabels{Labels: extra.MatchLabels}}
+		}
+		selectors[extra.Name] = selector
+	}
+	rsp.Requirements = &fnv1.Requirements{ExtraResources: selectors}
+}
+
+// waitForExtraResources checks if Crossplane has not supplied the extra resources of the input
+// yet, which is the case on the first run of the function
+func (f *Function) waitForExtraResources(req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
+	var missing []string
+	for _, extra := range in.ExtraResources {
+		if _, ok := req.GetExtraResources()[extra.Name]; !ok {
+			missing = append(missing, extra.Name)
+		}
+	}
+	if len(missing) == 0 {
+		return false
+	}
+
+	sort.Strings(missing)
+	f.log.Info("Waiting for extra resources", "extraResources", missing)
+	response.Normalf(rsp, "Waiting for extra resources: %s", strings.Join(missing, ", "))
+	return true
+}
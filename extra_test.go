@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestExtraResources(t *testing.T) {
+	var (
+		xr    = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		input = `{
+			"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+			"kind": "Input",
+			"queryType": "UserValidation",
+			"usersRef": "extraResource.teamUsers.data.users",
+			"target": "status.validatedUsers",
+			"extraResources": [
+				{"name": "teamUsers", "apiVersion": "apiextensions.crossplane.io/v1alpha1", "kind": "EnvironmentConfig", "matchName": "team-users"}
+			]
+		}`
+		requirements = &fnv1.Requirements{
+			ExtraResources: map[string]*fnv1.ResourceSelector{
+				"teamUsers": {
+					ApiVersion: "apiextensions.crossplane.io/v1alpha1",
+					Kind:       "EnvironmentConfig",
+					Match:      &fnv1.ResourceSelector_MatchName{MatchName: "team-users"},
+				},
+			},
+		}
+		teamUsers = `{
+			"apiVersion": "apiextensions.crossplane.io/v1alpha1",
+			"kind": "EnvironmentConfig",
+			"metadata": {"name": "team-users"},
+			"data": {"users": ["alice@example.com", "bob@example.com"], "group": "platform-admins"}
+		}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"RequestExtraResources": {
+			reason: "The Function should request the extra resources and wait for them before querying",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta:  &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(input),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "Waiting for extra resources: teamUsers",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Requirements: requirements,
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"ResolveFromExtraResources": {
+			reason: "The Function should resolve references from the extra resources supplied by Crossplane",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta:  &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(input),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					ExtraResources: map[string]*fnv1.Resources{
+						"teamUsers": {Items: []*fnv1.Resource{{Resource: resource.MustStructJSON(teamUsers)}}},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "UserValidation"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Requirements: requirements,
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"count": 2},
+								"status": {
+									"validatedUsers": [
+										{"id": "alice@example.com-id", "userPrincipalName": "alice@example.com"},
+										{"id": "bob@example.com-id", "userPrincipalName": "bob@example.com"}
+									]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"IndexObjectsByLabels": {
+			reason: "The Function should resolve a reference indexing the list of objects selected with matchLabels",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "UserValidation",
+						"usersRef": "extraResource.teams[0].data.users",
+						"target": "status.validatedUsers",
+						"extraResources": [
+							{"name": "teams", "apiVersion": "apiextensions.crossplane.io/v1alpha1", "kind": "EnvironmentConfig", "matchLabels": {"example.org/team": "platform"}}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					ExtraResources: map[string]*fnv1.Resources{
+						"teams": {Items: []*fnv1.Resource{{Resource: resource.MustStructJSON(teamUsers)}}},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "UserValidation"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Requirements: &fnv1.Requirements{
+						ExtraResources: map[string]*fnv1.ResourceSelector{
+							"teams": {
+								ApiVersion: "apiextensions.crossplane.io/v1alpha1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchLabels{
+									MatchLabels: &fnv1.MatchLabels{Labels: map[string]string{"example.org/team": "platform"}},
+								},
+							},
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"count": 2},
+								"status": {
+									"validatedUsers": [
+										{"id": "alice@example.com-id", "userPrincipalName": "alice@example.com"},
+										{"id": "bob@example.com-id", "userPrincipalName": "bob@example.com"}
+									]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"GroupRefSelectsSeveralObjects": {
+			reason: "The Function should fail when a single-valued reference selects several objects",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"groupRef": "extraResource.teams.data.group",
+						"target": "status.members",
+						"extraResources": [
+							{"name": "teams", "apiVersion": "apiextensions.crossplane.io/v1alpha1", "kind": "EnvironmentConfig", "matchLabels": {"example.org/team": "platform"}}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					ExtraResources: map[string]*fnv1.Resources{
+						"teams": {Items: []*fnv1.Resource{
+							{Resource: resource.MustStructJSON(teamUsers)},
+							{Resource: resource.MustStructJSON(teamUsers)},
+						}},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "cannot resolve groupRef: extraResource.teams.data.group selects a list of 2 objects by labels, select one with an index or a filter",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Requirements: &fnv1.Requirements{
+						ExtraResources: map[string]*fnv1.ResourceSelector{
+							"teams": {
+								ApiVersion: "apiextensions.crossplane.io/v1alpha1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchLabels{
+									MatchLabels: &fnv1.MatchLabels{Labels: map[string]string{"example.org/team": "platform"}},
+								},
+							},
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"GroupRefSelectsOneObjectByLabels": {
+			reason: "The Function should resolve objects selected with matchLabels to a list even when one object matches",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"groupRef": "extraResource.teams.data.group",
+						"target": "status.members",
+						"extraResources": [
+							{"name": "teams", "apiVersion": "apiextensions.crossplane.io/v1alpha1", "kind": "EnvironmentConfig", "matchLabels": {"example.org/team": "platform"}}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					ExtraResources: map[string]*fnv1.Resources{
+						"teams": {Items: []*fnv1.Resource{
+							{Resource: resource.MustStructJSON(teamUsers)},
+						}},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "cannot resolve groupRef: extraResource.teams.data.group selects a list of 1 objects by labels, select one with an index or a filter",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Requirements: &fnv1.Requirements{
+						ExtraResources: map[string]*fnv1.ResourceSelector{
+							"teams": {
+								ApiVersion: "apiextensions.crossplane.io/v1alpha1",
+								Kind:       "EnvironmentConfig",
+								Match: &fnv1.ResourceSelector_MatchLabels{
+									MatchLabels: &fnv1.MatchLabels{Labels: map[string]string{"example.org/team": "platform"}},
+								},
+							},
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"InvalidSelector": {
+			reason: "The Function should refuse an extra resource with both matchName and matchLabels",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "UserValidation",
+						"usersRef": "extraResource.teamUsers.data.users",
+						"target": "status.validatedUsers",
+						"extraResources": [
+							{"name": "teamUsers", "apiVersion": "v1", "kind": "ConfigMap", "matchName": "team-users", "matchLabels": {"team": "platform"}}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "extraResources[0]: exactly one of matchName or matchLabels is required",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
+					if in.QueryType != "UserValidation" {
+						return nil, errors.Errorf("unexpected query type: %s", in.QueryType)
+					}
+					results := make([]interface{}, 0, len(in.Users))
+					for _, u := range in.Users {
+						results = append(results, map[string]interface{}{"id": *u + "-id", "userPrincipalName": *u})
+					}
+					return results, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// errFieldRefsUnresolved is returned when the field references of the input cannot be resolved yet
+var errFieldRefsUnresolved = errors.New("cannot resolve fieldRefs")
+
+// fieldRefsProtectedFields are the fields of the input field references cannot set
+var fieldRefsProtectedFields = map[string]bool{
+	"apiVersion":     true,
+	"kind":           true,
+	"metadata":       true,
+	"fieldRefs":      true,
+	"extraResources": true,
+}
+
+// parseFieldRefPath parses the path of an input field set by a field reference
+func parseFieldRefPath(field string) ([]pathSegment, error) {
+	segments, err := parsePath(field)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid fieldRefs field %s", field)
+	}
+	if segments[0].kind != pathField {
+		return nil, errors.Errorf("invalid fieldRefs field %s: expected a field", field)
+	}
+	if fieldRefsProtectedFields[segments[0].field] {
+		return nil, errors.Errorf("invalid fieldRefs field %s: %s cannot be set by a reference", field, segments[0].field)
+	}
+	for _, segment := range segments {
+		if segment.kind == pathWildcard || segment.kind == pathFilter {
+			return nil, errors.Errorf("invalid fieldRefs field %s: wildcards and filters are not supported", field)
+		}
+	}
+	return segments, nil
+}
+
+// validateObservedFieldRefs checks that inputs rendering composed resources do not set fields
+// from observed composed resources, as validateObservedReferences does for query references
+func validateObservedFieldRefs(in *v1beta1.Input) error {
+	rendersResources := in.ResourceTemplate != nil
+	for _, q := range in.Queries {
+		rendersResources = rendersResources || q.ResourceTemplate != nil
+	}
+	if !rendersResources {
+		return nil
+	}
+
+	fields := make([]string, 0, len(in.FieldRefs))
+	for field := range in.FieldRefs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if referencesObserved(in.FieldRefs[field]) {
+			return errors.Errorf("resourceTemplate cannot be combined with references to observed composed resources, got fieldRefs[%s] %s", field, in.FieldRefs[field])
+		}
+	}
+	return nil
+}
+
+// resolveFieldRefs sets the fields of the input referenced by fieldRefs. It runs before
+// credentials are loaded, so references can select the identity or tenants of the query.
+// It requests the extra resources of the input first, as fieldRefs may reference them.
+func (f *Function) resolveFieldRefs(req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
+	if len(in.FieldRefs) == 0 {
+		return true
+	}
+
+	if err := validateExtraResources(in); err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+	requireExtraResources(rsp, in)
+	if f.waitForExtraResources(req, in, rsp) {
+		return false
+	}
+
+	if err := validateObservedFieldRefs(in); err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+
+	resolved, err := f.applyFieldRefs(req, in)
+	if err != nil {
+		f.handleReferenceError(rsp, err)
+		if isPendingReference(err) {
+			// Keep the data of the targets the input sets without references
+			if err := f.keepTargetData(req, rsp, in); err != nil {
+				response.Fatal(rsp, err)
+			}
+		}
+		return false
+	}
+	*in = *resolved
+	return true
+}
+
+// applyFieldRefs returns a copy of the input with the fields referenced by fieldRefs set
+// to their resolved values, decoded like the input itself
+func (f *Function) applyFieldRefs(req *fnv1.RunFunctionRequest, in *v1beta1.Input) (*v1beta1.Input, error) {
+	view, err := f.referenceView(req, in)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, 0, len(in.FieldRefs))
+	for field := range in.FieldRefs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var obj interface{} = req.GetInput().AsMap()
+	for _, field := range fields {
+		segments, err := parseFieldRefPath(field)
+		if err != nil {
+			return nil, err
+		}
+		refType := "fieldRefs[" + field + "]"
+		value, err := resolveRefValue(view, in.FieldRefs[field], refType)
+		if err != nil {
+			return nil, err
+		}
+		if obj, err = setPathValue(obj, segments, value); err != nil {
+			return nil, errors.Wrapf(err, "cannot set %s", refType)
+		}
+	}
+
+	objMap, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("input is not an object")
+	}
+	s, err := structpb.NewStruct(objMap)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert input with resolved fieldRefs")
+	}
+	resolved := &v1beta1.Input{}
+	if err := resource.AsObject(s, resolved); err != nil {
+		return nil, errors.Wrap(err, "cannot decode input with resolved fieldRefs")
+	}
+	return resolved, nil
+}
@@ -4,10 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"os"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	azauth "github.com/microsoft/kiota-authentication-azure-go"
 	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
@@ -41,6 +47,18 @@ const (
 	ClientSecret = "clientSecret"
 	// WorkloadIdentityCredentialPath defines the azure credentials key for federated token file path
 	WorkloadIdentityCredentialPath = "federatedTokenFile"
+	// ManagedIdentityResourceID defines the azure credentials key for user-assigned managed identity resource id
+	ManagedIdentityResourceID = "resourceId"
+	// DefaultCredentialsName defines the default name of the function credentials holding the azure credentials
+	DefaultCredentialsName = "azure-creds"
+	// DefaultCredentialsKey defines the default key of the azure credentials JSON in the function credentials data
+	DefaultCredentialsKey = "credentials"
+	// EnvironmentCredentialName defines the name of the credential configured by AZURE_* environment variables
+	EnvironmentCredentialName = "EnvironmentCredential"
+	// DefaultSortBy defines the default key query results are sorted by
+	DefaultSortBy = "id"
+	// GraphAPIVersion defines the version of the Microsoft Graph API queried by the function
+	GraphAPIVersion = "v1.0"
 )
 
 // GraphQueryInterface defines the methods required for querying Microsoft Graph API.
@@ -55,6 +73,17 @@ type Function struct {
 	graphQuery GraphQueryInterface
 
 	log logging.Logger
+
+	// clock returns the current time, defaults to time.Now
+	clock func() time.Time
+}
+
+// now returns the current time
+func (f *Function) now() time.Time {
+	if f.clock == nil {
+		return time.Now()
+	}
+	return f.clock()
 }
 
 // RunFunction runs the Function.
@@ -106,14 +135,32 @@ func (f *Function) parseInputAndCredentials(req *fnv1.RunFunctionRequest, rsp *f
 		return nil, nil, err
 	}
 
-	azureCreds, err := getCreds(req)
-	if err != nil {
-		response.Fatal(rsp, err)
-		return nil, nil, err
+	// Fields set by references, such as the identity, must be resolved before credentials are loaded
+	if !f.resolveFieldRefs(req, in, rsp) {
+		return nil, nil, errFieldRefsUnresolved
+	}
+
+	// Credentials of tenant fan-out queries are loaded per tenant
+	var azureCreds map[string]string
+	if len(in.Tenants) == 0 {
+		var err error
+		azureCreds, err = getCreds(req, in.Identity)
+		if err != nil {
+			response.Fatal(rsp, err)
+			return nil, nil, err
+		}
+
+		if err := validateCreds(azureCreds, in.Identity); err != nil {
+			response.ConditionFalse(rsp, "FunctionSuccess", "InvalidCredentials").
+				WithMessage(err.Error()).
+				TargetCompositeAndClaim()
+			response.Fatal(rsp, err)
+			return nil, nil, err
+		}
 	}
 
 	if f.graphQuery == nil {
-		f.graphQuery = &GraphQuery{}
+		f.graphQuery = &GraphQuery{log: f.log}
 	}
 
 	return in, azureCreds, nil
@@ -136,6 +183,15 @@ func (f *Function) getXRAndStatus(req *fnv1.RunFunctionRequest) (map[string]inte
 	return xrStatus, dxr, nil
 }
 
+// getDesiredXRAndStatus retrieves status and desired XR from the response, so that
+// results written by earlier queries of this function step are kept
+func (f *Function) getDesiredXRAndStatus(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse) (map[string]interface{}, *resource.Composite, error) {
+	return f.getXRAndStatus(&fnv1.RunFunctionRequest{
+		Observed: req.GetObserved(),
+		Desired:  rsp.GetDesired(),
+	})
+}
+
 // getObservedAndDesired gets both observed and desired XR resources
 func (f *Function) getObservedAndDesired(req *fnv1.RunFunctionRequest) (*resource.Composite, *resource.Composite, error) {
 	oxr, err := request.GetObservedCompositeResource(req)
@@ -192,39 +248,87 @@ func (f *Function) getStatusFromResources(oxr, dxr *resource.Composite) map[stri
 }
 
 // checkStatusTargetHasData checks if the status target has data.
-func (f *Function) checkStatusTargetHasData(req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
+func (f *Function) checkStatusTargetHasData(req *fnv1.RunFunctionRequest, target string) (bool, error) {
 	xrStatus, _, err := f.getXRAndStatus(req)
 	if err != nil {
-		response.Fatal(rsp, err)
-		return true
+		return false, err
 	}
 
-	statusField := strings.TrimPrefix(in.Target, "status.")
-	if hasData, _ := targetHasData(xrStatus, statusField); hasData {
-		f.log.Info("Target already has data, skipping query", "target", in.Target)
-		response.ConditionTrue(rsp, "FunctionSkip", "SkippedQuery").
-			WithMessage("Target already has data, skipped query to avoid throttling").
-			TargetCompositeAndClaim()
-		return true
-	}
-	return false
+	statusField := strings.TrimPrefix(target, "status.")
+	hasData, _ := targetHasData(xrStatus, statusField)
+	return hasData, nil
 }
 
 // executeQuery executes the query.
 func (f *Function) executeQuery(ctx context.Context, azureCreds map[string]string, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) (interface{}, error) {
-	// Initialize GraphQuery with logger if needed
-	if gq, ok := f.graphQuery.(*GraphQuery); ok {
-		gq.log = f.log
+	results, credential, err := f.runGraphQuery(ctx, azureCreds, in)
+	if err != nil {
+		setAuthenticationFailureCondition(rsp, err)
+		response.Fatal(rsp, err)
+		f.log.Info("FAILURE: ", "failure", fmt.Sprint(err))
+		return nil, err
 	}
 
+	// Print the obtained query results
+	f.log.Info("Query Type:", "queryType", in.QueryType)
+	f.log.Info("Results:", "results", fmt.Sprint(results))
+	response.Normalf(rsp, "QueryType: %q", in.QueryType)
+
+	// Report which credential of a chain authenticated the query
+	if credential != "" {
+		f.log.Info("Authenticated to Microsoft Graph", "credential", credential)
+		response.Normalf(rsp, "Authenticated using %s", credential)
+	}
+
+	return results, nil
+}
+
+// runGraphQuery runs the Graph query and returns its results along with the
+// name of the chained credential that authenticated it, if any.
+func (f *Function) runGraphQuery(ctx context.Context, azureCreds map[string]string, in *v1beta1.Input) (interface{}, string, error) {
+	ctx, recorder := withCredentialRecorder(ctx)
 	results, err := f.graphQuery.graphQuery(ctx, azureCreds, in)
 	if err != nil {
+		return nil, "", err
+	}
+	return results, recorder.credential(), nil
+}
+
+// executeTenantQueries runs the query against every tenant and merges the results under per-tenant keys.
+func (f *Function) executeTenantQueries(ctx context.Context, req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) (interface{}, error) {
+	policy := v1beta1.TenantFailurePolicyFailFast
+	if in.TenantFailurePolicy != nil && *in.TenantFailurePolicy != "" {
+		policy = *in.TenantFailurePolicy
+	}
+
+	results := make(map[string]interface{}, len(in.Tenants))
+	for _, tenant := range in.Tenants {
+		tenantResults, credential, err := f.queryTenant(ctx, req, in, tenant)
+		if err != nil {
+			err = errors.Wrapf(err, "query failed for tenant %s", tenant.Name)
+			f.log.Info("FAILURE: ", "failure", fmt.Sprint(err), "tenant", tenant.Name)
+			if policy != v1beta1.TenantFailurePolicyAllowPartial {
+				setAuthenticationFailureCondition(rsp, err)
+				response.Fatal(rsp, err)
+				return nil, err
+			}
+			response.Warning(rsp, err)
+			continue
+		}
+
+		if credential != "" {
+			f.log.Info("Authenticated to Microsoft Graph", "credential", credential, "tenant", tenant.Name)
+			response.Normalf(rsp, "Tenant %q authenticated using %s", tenant.Name, credential)
+		}
+		results[tenant.Name] = tenantResults
+	}
+
+	if len(results) == 0 {
+		err := errors.New("query failed for all tenants")
 		response.Fatal(rsp, err)
-		f.log.Info("FAILURE: ", "failure", fmt.Sprint(err))
 		return nil, err
 	}
 
-	// Print the obtained query results
 	f.log.Info("Query Type:", "queryType", in.QueryType)
 	f.log.Info("Results:", "results", fmt.Sprint(results))
 	response.Normalf(rsp, "QueryType: %q", in.QueryType)
@@ -232,8 +336,66 @@ func (f *Function) executeQuery(ctx context.Context, azureCreds map[string]strin
 	return results, nil
 }
 
-// processResults processes the query results.
-func (f *Function) processResults(req *fnv1.RunFunctionRequest, in *v1beta1.Input, results interface{}, rsp *fnv1.RunFunctionResponse) error {
+// tenantIdentity returns the identity a tenant is queried with: the identity of the input
+// with the fields the tenant sets overriding it
+func tenantIdentity(in *v1beta1.Input, tenant v1beta1.Tenant) *v1beta1.Identity {
+	if tenant.Identity == nil {
+		return in.Identity
+	}
+	identity := &v1beta1.Identity{}
+	if in.Identity != nil {
+		identity = in.Identity.DeepCopy()
+	}
+	if tenant.Identity.Type != "" {
+		identity.Type = tenant.Identity.Type
+	}
+	if tenant.Identity.CredentialsName != nil && *tenant.Identity.CredentialsName != "" {
+		identity.CredentialsName = tenant.Identity.CredentialsName
+	}
+	if tenant.Identity.CredentialsKey != nil && *tenant.Identity.CredentialsKey != "" {
+		identity.CredentialsKey = tenant.Identity.CredentialsKey
+	}
+	if tenant.Identity.ManagedIdentityClientID != nil && *tenant.Identity.ManagedIdentityClientID != "" {
+		identity.ManagedIdentityClientID = tenant.Identity.ManagedIdentityClientID
+	}
+	if tenant.Identity.ManagedIdentityResourceID != nil && *tenant.Identity.ManagedIdentityResourceID != "" {
+		identity.ManagedIdentityResourceID = tenant.Identity.ManagedIdentityResourceID
+	}
+	return identity
+}
+
+// queryTenant runs the query against a single tenant using the tenant identity and credentials.
+func (f *Function) queryTenant(ctx context.Context, req *fnv1.RunFunctionRequest, in *v1beta1.Input, tenant v1beta1.Tenant) (interface{}, string, error) {
+	tenantIn := in.DeepCopy()
+	tenantIn.Tenants = nil
+	tenantIn.Identity = tenantIdentity(in, tenant)
+
+	azureCreds, err := getCreds(req, tenantIn.Identity)
+	if err != nil {
+		return nil, "", err
+	}
+	if tenant.TenantID != nil && *tenant.TenantID != "" {
+		if azureCreds == nil {
+			azureCreds = map[string]string{}
+		}
+		azureCreds[TenantID] = *tenant.TenantID
+	}
+
+	if err := validateCreds(azureCreds, tenantIn.Identity); err != nil {
+		return nil, "", err
+	}
+
+	return f.runGraphQuery(ctx, azureCreds, tenantIn)
+}
+
+// processTargetResults processes the query results for a single target.
+func (f *Function) processTargetResults(req *fnv1.RunFunctionRequest, in *v1beta1.Input, results interface{}, rsp *fnv1.RunFunctionResponse) error {
+	results, err := shapeResults(in, results)
+	if err != nil {
+		response.Fatal(rsp, err)
+		return err
+	}
+
 	switch {
 	case strings.HasPrefix(in.Target, "status."):
 		err := f.putQueryResultToStatus(req, rsp, in, results)
@@ -247,6 +409,18 @@ func (f *Function) processResults(req *fnv1.RunFunctionRequest, in *v1beta1.Inpu
 			response.Fatal(rsp, err)
 			return err
 		}
+	case strings.HasPrefix(in.Target, "resource."):
+		err := f.putQueryResultToResource(rsp, in, results)
+		if err != nil {
+			response.Fatal(rsp, err)
+			return err
+		}
+	case strings.HasPrefix(in.Target, "metadata."):
+		err := f.putQueryResultToMetadata(req, rsp, in, results)
+		if err != nil {
+			response.Fatal(rsp, err)
+			return err
+		}
 	default:
 		// This should never happen because we check for valid targets earlier
 		response.Fatal(rsp, errors.Errorf("Unrecognized target field: %s", in.Target))
@@ -255,36 +429,191 @@ func (f *Function) processResults(req *fnv1.RunFunctionRequest, in *v1beta1.Inpu
 	return nil
 }
 
-func getCreds(req *fnv1.RunFunctionRequest) (map[string]string, error) {
+// getIdentityType returns the configured identity type, defaulting to AzureServicePrincipalCredentials
+func getIdentityType(identity *v1beta1.Identity) v1beta1.IdentityType {
+	if identity != nil && identity.Type != "" {
+		return identity.Type
+	}
+	return v1beta1.IdentityTypeAzureServicePrincipalCredentials
+}
+
+// getCredentialsSource returns the configured credentials name and data key, defaulting to azure-creds and credentials
+func getCredentialsSource(identity *v1beta1.Identity) (string, string) {
+	name, key := DefaultCredentialsName, DefaultCredentialsKey
+	if identity != nil {
+		if identity.CredentialsName != nil && *identity.CredentialsName != "" {
+			name = *identity.CredentialsName
+		}
+		if identity.CredentialsKey != nil && *identity.CredentialsKey != "" {
+			key = *identity.CredentialsKey
+		}
+	}
+	return name, key
+}
+
+// credentialsOptional reports whether the identity type can authenticate without azure-creds credentials
+func credentialsOptional(identityType v1beta1.IdentityType) bool {
+	return identityType == v1beta1.IdentityTypeAzureManagedIdentityCredentials ||
+		identityType == v1beta1.IdentityTypeAzureDefaultCredentials
+}
+
+func getCreds(req *fnv1.RunFunctionRequest, identity *v1beta1.Identity) (map[string]string, error) {
 	var azureCreds map[string]string
 	rawCreds := req.GetCredentials()
+	credsName, credsKey := getCredentialsSource(identity)
 
-	if credsData, ok := rawCreds["azure-creds"]; ok {
+	if credsData, ok := rawCreds[credsName]; ok {
 		credsData := credsData.GetCredentialData().GetData()
-		if credsJSON, ok := credsData["credentials"]; ok {
+		if credsJSON, ok := credsData[credsKey]; ok {
 			err := json.Unmarshal(credsJSON, &azureCreds)
 			if err != nil {
 				return nil, errors.Wrap(err, "cannot parse json credentials")
 			}
 		}
 	} else {
-		return nil, errors.New("failed to get azure-creds credentials")
+		if credentialsOptional(getIdentityType(identity)) {
+			return map[string]string{}, nil
+		}
+		return nil, errors.Errorf("failed to get %s credentials", credsName)
 	}
 
 	return azureCreds, nil
 }
 
+// validateCreds checks that the credentials hold every key required by the identity type
+func validateCreds(azureCreds map[string]string, identity *v1beta1.Identity) error {
+	identityType := getIdentityType(identity)
+
+	var required []string
+	switch identityType {
+	case v1beta1.IdentityTypeAzureServicePrincipalCredentials:
+		required = []string{TenantID, ClientID, ClientSecret}
+	case v1beta1.IdentityTypeAzureWorkloadIdentityCredentials:
+		// The token file defaults to the value of the environment variable AZURE_FEDERATED_TOKEN_FILE
+		if os.Getenv("AZURE_FEDERATED_TOKEN_FILE") == "" {
+			required = []string{WorkloadIdentityCredentialPath}
+		}
+	case v1beta1.IdentityTypeAzureManagedIdentityCredentials:
+		if clientID, resourceID := managedIdentityIDs(azureCreds, identity); clientID != "" && resourceID != "" {
+			return errors.Errorf("only one of managed identity client id and resource id can be set for %s", identityType)
+		}
+	case v1beta1.IdentityTypeAzureDefaultCredentials:
+		// Every credential of the chain is optional
+	default:
+		return errors.Errorf("unsupported identity.type: %s", identityType)
+	}
+
+	var missing []string
+	for _, key := range required {
+		if azureCreds[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("missing %s for %s", strings.Join(missing, ", "), identityType)
+	}
+	return nil
+}
+
+// authenticationFailure describes how an AADSTS error is reported
+type authenticationFailure struct {
+	reason string
+	hint   string
+}
+
+var (
+	// aadstsCodePattern matches the AADSTS error code in an authentication error
+	aadstsCodePattern = regexp.MustCompile(`AADSTS(\d+)`)
+
+	// aadstsFailures maps well-known AADSTS error codes to FunctionSuccess condition reasons
+	aadstsFailures = map[string]authenticationFailure{
+		"7000215": {reason: "InvalidClientSecret", hint: "the client secret is invalid, check clientSecret in the credentials"},
+		"7000222": {reason: "ExpiredClientSecret", hint: "the client secret has expired, rotate clientSecret in the credentials"},
+		"700016":  {reason: "ApplicationNotFound", hint: "the application was not found in the tenant, check clientId and tenantId in the credentials"},
+		"90002":   {reason: "TenantNotFound", hint: "the tenant was not found, check tenantId in the credentials"},
+		"900023":  {reason: "TenantNotFound", hint: "the tenant identifier is invalid, check tenantId in the credentials"},
+		"65001":   {reason: "ConsentRequired", hint: "admin consent for the Microsoft Graph API permissions has not been granted"},
+		"70021":   {reason: "InvalidFederatedCredential", hint: "no federated identity credential matches the service account token"},
+		"700024":  {reason: "InvalidFederatedCredential", hint: "the service account token has expired or is not yet valid"},
+		"7000229": {reason: "ServicePrincipalNotFound", hint: "the application has no service principal in the tenant"},
+		"53003":   {reason: "ConditionalAccessBlocked", hint: "access has been blocked by conditional access policies"},
+	}
+)
+
+// setAuthenticationFailureCondition sets a FunctionSuccess condition with an actionable reason if err is an AADSTS error
+func setAuthenticationFailureCondition(rsp *fnv1.RunFunctionResponse, err error) {
+	match := aadstsCodePattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return
+	}
+
+	failure, ok := aadstsFailures[match[1]]
+	if !ok {
+		failure = authenticationFailure{reason: "AuthenticationFailed", hint: "authentication to Microsoft Graph failed"}
+	}
+
+	response.ConditionFalse(rsp, "FunctionSuccess", failure.reason).
+		WithMessage(fmt.Sprintf("%s: %s", match[0], failure.hint)).
+		TargetCompositeAndClaim()
+}
+
 // GraphQuery is a concrete implementation of the GraphQueryInterface
 // that interacts with Microsoft Graph API.
 type GraphQuery struct {
 	log logging.Logger
 }
 
+// graphClientCacheKey is the context key of the graphClientCache
+type graphClientCacheKey struct{}
+
+// graphClientCache shares Microsoft Graph clients between the queries of a function step
+type graphClientCache struct {
+	mu      sync.Mutex
+	clients map[string]*msgraphsdk.GraphServiceClient
+}
+
+// withGraphClientCache returns a context carrying a new graphClientCache
+func withGraphClientCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, graphClientCacheKey{}, &graphClientCache{
+		clients: make(map[string]*msgraphsdk.GraphServiceClient),
+	})
+}
+
+// graphClient returns the Microsoft Graph client for the credentials and identity,
+// reusing a client from the graphClientCache of the context if there is one
+func (g *GraphQuery) graphClient(ctx context.Context, azureCreds map[string]string, in *v1beta1.Input) (*msgraphsdk.GraphServiceClient, error) {
+	cache, ok := ctx.Value(graphClientCacheKey{}).(*graphClientCache)
+	if !ok {
+		return g.createGraphClient(azureCreds, in)
+	}
+
+	key, err := json.Marshal(struct {
+		Creds    map[string]string `json:"creds"`
+		Identity *v1beta1.Identity `json:"identity"`
+	}{Creds: azureCreds, Identity: in.Identity})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot compute graph client cache key")
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if client, ok := cache.clients[string(key)]; ok {
+		return client, nil
+	}
+
+	client, err := g.createGraphClient(azureCreds, in)
+	if err != nil {
+		return nil, err
+	}
+	cache.clients[string(key)] = client
+	return client, nil
+}
+
 // createGraphClient initializes a Microsoft Graph client using the provided credentials
-func (g *GraphQuery) createGraphClient(azureCreds map[string]string, identityType v1beta1.IdentityType) (client *msgraphsdk.GraphServiceClient, err error) {
+func (g *GraphQuery) createGraphClient(azureCreds map[string]string, in *v1beta1.Input) (client *msgraphsdk.GraphServiceClient, err error) {
 	authProvider := &azauth.AzureIdentityAuthenticationProvider{}
 
-	switch identityType {
+	switch getIdentityType(in.Identity) {
 	case v1beta1.IdentityTypeAzureWorkloadIdentityCredentials:
 		authProvider, err = g.initializeWorkloadIdentityProvider(azureCreds)
 		if err != nil {
@@ -295,6 +624,16 @@ func (g *GraphQuery) createGraphClient(azureCreds map[string]string, identityTyp
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to initialize service principal provider")
 		}
+	case v1beta1.IdentityTypeAzureManagedIdentityCredentials:
+		authProvider, err = g.initializeManagedIdentityProvider(azureCreds, in.Identity)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize managed identity provider")
+		}
+	case v1beta1.IdentityTypeAzureDefaultCredentials:
+		authProvider, err = g.initializeDefaultProvider(azureCreds, in.Identity)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize default credentials provider")
+		}
 	}
 
 	// Create adapter
@@ -308,6 +647,15 @@ func (g *GraphQuery) createGraphClient(azureCreds map[string]string, identityTyp
 }
 
 func (g *GraphQuery) initializeClientSecretProvider(azureCreds map[string]string) (*azauth.AzureIdentityAuthenticationProvider, error) {
+	cred, err := g.newClientSecretCredential(azureCreds)
+	if err != nil {
+		return nil, err
+	}
+	return newAuthProvider(cred)
+}
+
+// newClientSecretCredential creates a client secret credential from the azure credentials
+func (g *GraphQuery) newClientSecretCredential(azureCreds map[string]string) (azcore.TokenCredential, error) {
 	tenantID := azureCreds[TenantID]
 	clientID := azureCreds[ClientID]
 	clientSecret := azureCreds[ClientSecret]
@@ -317,16 +665,19 @@ func (g *GraphQuery) initializeClientSecretProvider(azureCreds map[string]string
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to obtain clientsecret credentials")
 	}
-	// Create authentication provider
-	authProvider, err := azauth.NewAzureIdentityAuthenticationProviderWithScopes(cred, MSGraphScopes)
+	return cred, nil
+}
+
+func (g *GraphQuery) initializeWorkloadIdentityProvider(azureCreds map[string]string) (*azauth.AzureIdentityAuthenticationProvider, error) {
+	cred, err := g.newWorkloadIdentityCredential(azureCreds)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create auth provider")
+		return nil, err
 	}
-
-	return authProvider, nil
+	return newAuthProvider(cred)
 }
 
-func (g *GraphQuery) initializeWorkloadIdentityProvider(azureCreds map[string]string) (*azauth.AzureIdentityAuthenticationProvider, error) {
+// newWorkloadIdentityCredential creates a workload identity credential from the azure credentials
+func (g *GraphQuery) newWorkloadIdentityCredential(azureCreds map[string]string) (azcore.TokenCredential, error) {
 	options := &azidentity.WorkloadIdentityCredentialOptions{
 		TokenFilePath: azureCreds[WorkloadIdentityCredentialPath],
 	}
@@ -348,24 +699,229 @@ func (g *GraphQuery) initializeWorkloadIdentityProvider(azureCreds map[string]st
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to obtain workloadidentity credentials")
 	}
-	// Create authentication provider
+	return cred, nil
+}
+
+func (g *GraphQuery) initializeManagedIdentityProvider(azureCreds map[string]string, identity *v1beta1.Identity) (*azauth.AzureIdentityAuthenticationProvider, error) {
+	cred, err := g.newManagedIdentityCredential(azureCreds, identity)
+	if err != nil {
+		return nil, err
+	}
+	return newAuthProvider(cred)
+}
+
+// newManagedIdentityCredential creates a managed identity credential, selecting a user-assigned identity if configured
+func (g *GraphQuery) newManagedIdentityCredential(azureCreds map[string]string, identity *v1beta1.Identity) (azcore.TokenCredential, error) {
+	options := &azidentity.ManagedIdentityCredentialOptions{}
+
+	// Use the system-assigned identity unless a user-assigned identity is selected
+	clientID, resourceID := managedIdentityIDs(azureCreds, identity)
+	switch {
+	case clientID != "" && resourceID != "":
+		return nil, errors.New("only one of managed identity client id and resource id can be set")
+	case clientID != "":
+		options.ID = azidentity.ClientID(clientID)
+	case resourceID != "":
+		options.ID = azidentity.ResourceID(resourceID)
+	}
+
+	// Create Azure credential for Microsoft Graph
+	cred, err := azidentity.NewManagedIdentityCredential(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to obtain managedidentity credentials")
+	}
+	return cred, nil
+}
+
+// managedIdentityIDs returns the user-assigned managed identity client and resource id
+// from the identity, falling back to the credentials
+func managedIdentityIDs(azureCreds map[string]string, identity *v1beta1.Identity) (string, string) {
+	clientID, resourceID := azureCreds[ClientID], azureCreds[ManagedIdentityResourceID]
+	if identity != nil {
+		clientID = ptr.Deref(identity.ManagedIdentityClientID, clientID)
+		resourceID = ptr.Deref(identity.ManagedIdentityResourceID, resourceID)
+	}
+	return clientID, resourceID
+}
+
+// initializeDefaultProvider chains the workload identity, managed identity, environment
+// and client secret credentials, using the first one that authenticates successfully
+func (g *GraphQuery) initializeDefaultProvider(azureCreds map[string]string, identity *v1beta1.Identity) (*azauth.AzureIdentityAuthenticationProvider, error) {
+	candidates := []struct {
+		name          string
+		newCredential func() (azcore.TokenCredential, error)
+		probe         func(ctx context.Context) error
+	}{
+		{
+			name:          string(v1beta1.IdentityTypeAzureWorkloadIdentityCredentials),
+			newCredential: func() (azcore.TokenCredential, error) { return g.newWorkloadIdentityCredential(azureCreds) },
+		},
+		{
+			name:          string(v1beta1.IdentityTypeAzureManagedIdentityCredentials),
+			newCredential: func() (azcore.TokenCredential, error) { return g.newManagedIdentityCredential(azureCreds, identity) },
+			// Off Azure, the managed identity credential retries the unreachable IMDS endpoint until the context expires
+			probe: func(ctx context.Context) error { return probeIMDS(ctx, imdsEndpoint) },
+		},
+		{
+			name: EnvironmentCredentialName,
+			newCredential: func() (azcore.TokenCredential, error) {
+				return azidentity.NewEnvironmentCredential(nil)
+			},
+		},
+		{
+			name: string(v1beta1.IdentityTypeAzureServicePrincipalCredentials),
+			newCredential: func() (azcore.TokenCredential, error) {
+				if azureCreds[ClientSecret] == "" {
+					return nil, errors.New("no client secret in credentials")
+				}
+				return g.newClientSecretCredential(azureCreds)
+			},
+		},
+	}
+
+	chain := &credentialChain{}
+	for _, c := range candidates {
+		cred, err := c.newCredential()
+		if err != nil {
+			// Credentials which cannot be configured in this environment are left out of the chain
+			if g.log != nil {
+				g.log.Debug("Skipping unavailable credential", "credential", c.name, "error", err)
+			}
+			continue
+		}
+		chain.sources = append(chain.sources, credentialSource{name: c.name, cred: cred, probe: c.probe})
+	}
+
+	if len(chain.sources) == 0 {
+		return nil, errors.New("no credential is available in this environment")
+	}
+	return newAuthProvider(chain)
+}
+
+// newAuthProvider creates a Microsoft Graph authentication provider for the credential
+func newAuthProvider(cred azcore.TokenCredential) (*azauth.AzureIdentityAuthenticationProvider, error) {
 	authProvider, err := azauth.NewAzureIdentityAuthenticationProviderWithScopes(cred, MSGraphScopes)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create auth provider")
 	}
-
 	return authProvider, nil
 }
 
-// graphQuery is a concrete implementation that interacts with Microsoft Graph API.
-func (g *GraphQuery) graphQuery(ctx context.Context, azureCreds map[string]string, in *v1beta1.Input) (interface{}, error) {
-	identityType := v1beta1.IdentityTypeAzureServicePrincipalCredentials
+// imdsEndpoint is the token endpoint of the Azure instance metadata service
+var imdsEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
 
-	if in.Identity != nil && in.Identity.Type != "" {
-		identityType = in.Identity.Type
+// imdsProbeTimeout is how long probeIMDS waits for the instance metadata service to respond
+const imdsProbeTimeout = time.Second
+
+// probeIMDS checks that the instance metadata service at endpoint responds, unless the managed
+// identity is served by another endpoint, e.g. in App Service or Azure Arc
+func probeIMDS(ctx context.Context, endpoint string) error {
+	if os.Getenv("IDENTITY_ENDPOINT") != "" || os.Getenv("MSI_ENDPOINT") != "" {
+		return nil
 	}
-	// Create the Microsoft Graph client
-	client, err := g.createGraphClient(azureCreds, identityType)
+
+	ctx, cancel := context.WithTimeout(ctx, imdsProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot create IMDS probe request")
+	}
+	// The instance metadata service is link-local, so it is never reached through a proxy
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "IMDS endpoint did not respond")
+	}
+	return resp.Body.Close()
+}
+
+// credentialSource is a credential of a credentialChain
+type credentialSource struct {
+	name string
+	cred azcore.TokenCredential
+	// probe checks that the credential is available before it requests a token, if set
+	probe func(ctx context.Context) error
+}
+
+// credentialChain requests a token from its sources in turn, falling through to the next source
+// whenever one is unavailable or fails. The source which authenticated is used from then on and
+// its name is recorded on the credentialRecorder of the request context.
+type credentialChain struct {
+	sources []credentialSource
+
+	mu         sync.Mutex
+	successful *credentialSource
+}
+
+// GetToken requests an access token from the first source of the chain which authenticates
+func (c *credentialChain) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s := c.successful; s != nil {
+		token, err := s.cred.GetToken(ctx, opts)
+		if err == nil {
+			recordCredential(ctx, s.name)
+		}
+		return token, err
+	}
+
+	failures := make([]string, 0, len(c.sources))
+	for i := range c.sources {
+		s := &c.sources[i]
+		if s.probe != nil {
+			if err := s.probe(ctx); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", s.name, err))
+				continue
+			}
+		}
+		token, err := s.cred.GetToken(ctx, opts)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", s.name, err))
+			continue
+		}
+		c.successful = s
+		recordCredential(ctx, s.name)
+		return token, nil
+	}
+	return azcore.AccessToken{}, errors.Errorf("no credential authenticated: %s", strings.Join(failures, "; "))
+}
+
+// credentialRecorderKey is the context key of the credentialRecorder
+type credentialRecorderKey struct{}
+
+// credentialRecorder records which credential of a chain authenticated the queries of a request
+type credentialRecorder struct {
+	mu   sync.Mutex
+	name string
+}
+
+// withCredentialRecorder returns a context carrying a new credentialRecorder
+func withCredentialRecorder(ctx context.Context) (context.Context, *credentialRecorder) {
+	r := &credentialRecorder{}
+	return context.WithValue(ctx, credentialRecorderKey{}, r), r
+}
+
+// recordCredential records the credential name on the credentialRecorder of the context, if any
+func recordCredential(ctx context.Context, name string) {
+	if r, ok := ctx.Value(credentialRecorderKey{}).(*credentialRecorder); ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.name = name
+	}
+}
+
+// credential returns the name of the recorded credential
+func (r *credentialRecorder) credential() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.name
+}
+
+// graphQuery is a concrete implementation that interacts with Microsoft Graph API.
+func (g *GraphQuery) graphQuery(ctx context.Context, azureCreds map[string]string, in *v1beta1.Input) (interface{}, error) {
+	// Create the Microsoft Graph client, or reuse the one shared by the queries of this function step
+	client, err := g.graphClient(ctx, azureCreds, in)
 	if err != nil {
 		return nil, err
 	}
@@ -376,6 +932,8 @@ func (g *GraphQuery) graphQuery(ctx context.Context, azureCreds map[string]strin
 		return g.validateUsers(ctx, client, in)
 	case "GroupMembership":
 		return g.getGroupMembers(ctx, client, in)
+	case "GroupMembershipDrift":
+		return g.getGroupMembershipDrift(ctx, client, in)
 	case "GroupObjectIDs":
 		return g.getGroupObjectIDs(ctx, client, in)
 	case "ServicePrincipalDetails":
@@ -642,6 +1200,16 @@ func (g *GraphQuery) getGroupMembers(ctx context.Context, client *msgraphsdk.Gra
 	return members, nil
 }
 
+// getGroupMembershipDrift compares the declared members with the actual members of the specified group
+func (g *GraphQuery) getGroupMembershipDrift(ctx context.Context, client *msgraphsdk.GraphServiceClient, in *v1beta1.Input) (interface{}, error) {
+	members, err := g.getGroupMembers(ctx, client, in)
+	if err != nil {
+		return nil, err
+	}
+	memberList, _ := members.([]interface{})
+	return membershipDrift(in.Members, memberList), nil
+}
+
 // getGroupObjectIDs retrieves object IDs for the specified group names
 func (g *GraphQuery) getGroupObjectIDs(ctx context.Context, client *msgraphsdk.GraphServiceClient, in *v1beta1.Input) (interface{}, error) {
 	if len(in.Groups) == 0 {
@@ -817,13 +1385,18 @@ func SetNestedKey(root map[string]interface{}, key string, value interface{}) er
 
 // putQueryResultToStatus processes the query results to status
 func (f *Function) putQueryResultToStatus(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input, results interface{}) error {
-	xrStatus, dxr, err := f.getXRAndStatus(req)
+	xrStatus, dxr, err := f.getDesiredXRAndStatus(req, rsp)
 	if err != nil {
 		return err
 	}
 
 	// Update the specific status field
 	statusField := strings.TrimPrefix(in.Target, "status.")
+	existing := pipelineStatusValue(req, xrStatus, statusField)
+	results, err = f.storedResults(req, in, existing, results)
+	if err != nil {
+		return errors.Wrapf(err, "cannot merge results into status field %s", statusField)
+	}
 	err = SetNestedKey(xrStatus, statusField, results)
 	if err != nil {
 		return errors.Wrapf(err, "cannot set status field %s to %v", statusField, results)
@@ -848,10 +1421,16 @@ func putQueryResultToContext(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunction
 		return errors.Wrap(err, "cannot convert results data to structpb.Value")
 	}
 
-	// Convert existing context into a map[string]interface{}
-	contextMap := req.GetContext().AsMap()
+	// Convert existing context into a map[string]interface{}, keeping results of earlier queries
+	contextMap := rsp.GetContext().AsMap()
+
+	existing, _ := nestedValue(contextMap, contextField)
+	merged, err := f.storedResults(req, in, existing, data.AsInterface())
+	if err != nil {
+		return errors.Wrapf(err, "cannot merge results into context key %s", contextField)
+	}
 
-	err = SetNestedKey(contextMap, contextField, data.AsInterface())
+	err = SetNestedKey(contextMap, contextField, merged)
 	if err != nil {
 		return errors.Wrap(err, "failed to update context key")
 	}
@@ -871,51 +1450,66 @@ func putQueryResultToContext(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunction
 
 // targetHasData checks if a target field already has data
 func targetHasData(data map[string]interface{}, key string) (bool, error) {
+	if _, err := ParseNestedKey(key); err != nil {
+		return false, err
+	}
+
+	value, exists := nestedValue(data, key)
+	if !exists {
+		// Key doesn't exist, so no data
+		return false, nil
+	}
+	return valueHasData(value), nil
+}
+
+// nestedValue retrieves a nested value from a map using dot notation keys
+func nestedValue(data map[string]interface{}, key string) (interface{}, bool) {
 	parts, err := ParseNestedKey(key)
 	if err != nil {
-		return false, err
+		return nil, false
 	}
 
 	currentValue := interface{}(data)
 	for _, k := range parts {
 		// Check if the current value is a map
-		if nestedMap, ok := currentValue.(map[string]interface{}); ok {
-			// Get the next value in the nested map
-			if nextValue, exists := nestedMap[k]; exists {
-				currentValue = nextValue
-			} else {
-				// Key doesn't exist, so no data
-				return false, nil
-			}
-		} else {
+		nestedMap, ok := currentValue.(map[string]interface{})
+		if !ok {
 			// Not a map, so can't traverse further
-			return false, nil
+			return nil, false
 		}
+		// Get the next value in the nested map
+		nextValue, exists := nestedMap[k]
+		if !exists {
+			return nil, false
+		}
+		currentValue = nextValue
 	}
+	return currentValue, true
+}
 
-	// If we've reached here, the key exists
-	// Check if it has meaningful data (not nil and not empty)
-	if currentValue == nil {
-		return false, nil
+// valueHasData checks if a value has meaningful data (not nil and not empty)
+func valueHasData(value interface{}) bool {
+	if value == nil {
+		return false
 	}
 
 	// Check for empty maps
-	if nestedMap, ok := currentValue.(map[string]interface{}); ok {
-		return len(nestedMap) > 0, nil
+	if nestedMap, ok := value.(map[string]interface{}); ok {
+		return len(nestedMap) > 0
 	}
 
 	// Check for empty slices
-	if slice, ok := currentValue.([]interface{}); ok {
-		return len(slice) > 0, nil
+	if slice, ok := value.([]interface{}); ok {
+		return len(slice) > 0
 	}
 
 	// For strings, check if empty
-	if str, ok := currentValue.(string); ok {
-		return str != "", nil
+	if str, ok := value.(string); ok {
+		return str != ""
 	}
 
 	// For other types (numbers, booleans), consider them as having data
-	return true, nil
+	return true
 }
 
 // propagateDesiredXR ensures the desired XR is properly propagated without changing existing data
@@ -968,22 +1562,73 @@ func (f *Function) initializeResponse(req *fnv1.RunFunctionRequest, rsp *fnv1.Ru
 
 // validateAndPrepareInput validates the input and prepares it for execution
 func (f *Function) validateAndPrepareInput(_ context.Context, req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
-	// Check if target is valid
-	if !f.isValidTarget(in.Target) {
-		response.Fatal(rsp, errors.Errorf("Unrecognized target field: %s", in.Target))
+	// Check if tenants are valid
+	if err := validateTenants(in); err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+
+	// Request the extra resources references are resolved from, and wait until they are supplied
+	if err := validateExtraResources(in); err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+	requireExtraResources(rsp, in)
+	if f.waitForExtraResources(req, in, rsp) {
+		return false
+	}
+
+	// Multiple queries are prepared individually before they are executed
+	if len(in.Queries) > 0 {
+		if err := validateQueries(in); err != nil {
+			response.Fatal(rsp, err)
+			return false
+		}
+		return true
+	}
+
+	// Check if targets are valid
+	if err := f.validateTargets(in); err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+
+	// Check if transform and output format are valid
+	if err := validateResultOptions(in); err != nil {
+		response.Fatal(rsp, err)
 		return false
 	}
 
 	// Check if we should skip the query
 	if f.shouldSkipQuery(req, in, rsp) {
+		// Keep the data of the targets which are not kept with the XR status and the context
+		if err := f.keepTargetData(req, rsp, in); err != nil {
+			response.Fatal(rsp, err)
+			return false
+		}
 		// Set success condition
 		response.ConditionTrue(rsp, "FunctionSuccess", "Success").
 			TargetCompositeAndClaim()
 		return false
 	}
 
+	// Check if the refresh interval has elapsed since the last query
+	if f.skipUntilRefresh(req, in, rsp) {
+		if !hasFatalResult(rsp) {
+			response.ConditionTrue(rsp, "FunctionSuccess", "Success").
+				TargetCompositeAndClaim()
+		}
+		return false
+	}
+
 	// Process references based on query type
 	if !f.processReferences(req, in, rsp) {
+		// A query skipped until its references can be resolved keeps the data of its targets
+		if !hasFatalResult(rsp) {
+			if err := f.keepTargetData(req, rsp, in); err != nil {
+				response.Fatal(rsp, err)
+			}
+		}
 		return false
 	}
 
@@ -996,6 +1641,8 @@ func (f *Function) processReferences(req *fnv1.RunFunctionRequest, in *v1beta1.I
 	switch in.QueryType {
 	case "GroupMembership":
 		return f.processGroupRef(req, in, rsp)
+	case "GroupMembershipDrift":
+		return f.processGroupRef(req, in, rsp) && f.processMembersRef(req, in, rsp)
 	case "GroupObjectIDs":
 		return f.processGroupsRef(req, in, rsp)
 	case "UserValidation":
@@ -1006,15 +1653,15 @@ func (f *Function) processReferences(req *fnv1.RunFunctionRequest, in *v1beta1.I
 	return true
 }
 
-// processGroupRef handles resolving the groupRef reference for GroupMembership query type
+// processGroupRef handles resolving the groupRef reference for GroupMembership and GroupMembershipDrift query types
 func (f *Function) processGroupRef(req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
 	if in.GroupRef == nil || *in.GroupRef == "" {
 		return true
 	}
 
-	groupName, err := f.resolveGroupRef(req, in.GroupRef)
+	groupName, err := f.resolveGroupRef(req, in, in.GroupRef)
 	if err != nil {
-		response.Fatal(rsp, err)
+		f.handleReferenceError(rsp, err)
 		return false
 	}
 	in.Group = &groupName
@@ -1028,9 +1675,9 @@ func (f *Function) processGroupsRef(req *fnv1.RunFunctionRequest, in *v1beta1.In
 		return true
 	}
 
-	groupNames, err := f.resolveGroupsRef(req, in.GroupsRef)
+	groupNames, err := f.resolveGroupsRef(req, in, in.GroupsRef)
 	if err != nil {
-		response.Fatal(rsp, err)
+		f.handleReferenceError(rsp, err)
 		return false
 	}
 	in.Groups = groupNames
@@ -1044,9 +1691,9 @@ func (f *Function) processUsersRef(req *fnv1.RunFunctionRequest, in *v1beta1.Inp
 		return true
 	}
 
-	userNames, err := f.resolveUsersRef(req, in.UsersRef)
+	userNames, err := f.resolveUsersRef(req, in, in.UsersRef)
 	if err != nil {
-		response.Fatal(rsp, err)
+		f.handleReferenceError(rsp, err)
 		return false
 	}
 	in.Users = userNames
@@ -1060,9 +1707,9 @@ func (f *Function) processServicePrincipalsRef(req *fnv1.RunFunctionRequest, in
 		return true
 	}
 
-	spNames, err := f.resolveServicePrincipalsRef(req, in.ServicePrincipalsRef)
+	spNames, err := f.resolveServicePrincipalsRef(req, in, in.ServicePrincipalsRef)
 	if err != nil {
-		response.Fatal(rsp, err)
+		f.handleReferenceError(rsp, err)
 		return false
 	}
 	in.ServicePrincipals = spNames
@@ -1070,10 +1717,30 @@ func (f *Function) processServicePrincipalsRef(req *fnv1.RunFunctionRequest, in
 	return true
 }
 
+// processMembersRef handles resolving the membersRef reference for GroupMembershipDrift query type
+func (f *Function) processMembersRef(req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
+	if in.MembersRef == nil || *in.MembersRef == "" {
+		return true
+	}
+
+	members, err := f.resolveStringArrayRef(req, in, in.MembersRef, "membersRef")
+	if err != nil {
+		f.handleReferenceError(rsp, err)
+		return false
+	}
+	in.Members = members
+	f.log.Info("Resolved MembersRef to members", "memberCount", len(members), "membersRef", *in.MembersRef)
+	return true
+}
+
 // executeAndProcessQuery executes the query and processes the results
 func (f *Function) executeAndProcessQuery(ctx context.Context, req *fnv1.RunFunctionRequest, in *v1beta1.Input, azureCreds map[string]string, rsp *fnv1.RunFunctionResponse) bool {
+	if len(in.Queries) > 0 {
+		return f.executeAndProcessQueries(ctx, req, in, azureCreds, rsp)
+	}
+
 	// Execute the query
-	results, err := f.executeQuery(ctx, azureCreds, in, rsp)
+	results, err := f.executeInput(ctx, req, in, azureCreds, rsp)
 	if err != nil {
 		return false
 	}
@@ -1083,14 +1750,69 @@ func (f *Function) executeAndProcessQuery(ctx context.Context, req *fnv1.RunFunc
 		return false
 	}
 
+	// Store the time of the query for the refresh interval
+	if err := f.recordQueryTime(req, rsp, in); err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+
+	// Check the assertions on the query results
+	if len(in.Assertions) > 0 {
+		failures, err := f.evaluateAssertions(req, in, results)
+		if err != nil {
+			response.Fatal(rsp, err)
+			return false
+		}
+		return gateReadiness(rsp, failures, getAssertionFailurePolicy(in))
+	}
+
 	return true
 }
 
+// executeInput executes the query of the input, fanning out to the tenants if configured
+func (f *Function) executeInput(ctx context.Context, req *fnv1.RunFunctionRequest, in *v1beta1.Input, azureCreds map[string]string, rsp *fnv1.RunFunctionResponse) (interface{}, error) {
+	if len(in.Tenants) > 0 {
+		return f.executeTenantQueries(ctx, req, in, rsp)
+	}
+	return f.executeQuery(ctx, azureCreds, in, rsp)
+}
+
 // isValidTarget checks if the target is valid
 func (f *Function) isValidTarget(target string) bool {
+	if strings.HasPrefix(target, "resource.") {
+		_, _, err := parseResourceTarget(target)
+		return err == nil
+	}
+	if strings.HasPrefix(target, "metadata.") {
+		_, _, err := parseMetadataTarget(target)
+		return err == nil
+	}
 	return strings.HasPrefix(target, "status.") || strings.HasPrefix(target, "context.")
 }
 
+// validateTenants checks that tenant names are set and unique, as they key the results
+func validateTenants(in *v1beta1.Input) error {
+	seen := make(map[string]bool, len(in.Tenants))
+	for i, tenant := range in.Tenants {
+		if tenant.Name == "" {
+			return errors.Errorf("tenants[%d]: name is required", i)
+		}
+		if seen[tenant.Name] {
+			return errors.Errorf("tenants[%d]: duplicate tenant name %s", i, tenant.Name)
+		}
+		seen[tenant.Name] = true
+	}
+
+	if in.TenantFailurePolicy != nil {
+		switch *in.TenantFailurePolicy {
+		case "", v1beta1.TenantFailurePolicyFailFast, v1beta1.TenantFailurePolicyAllowPartial:
+		default:
+			return errors.Errorf("unsupported tenantFailurePolicy: %s", *in.TenantFailurePolicy)
+		}
+	}
+	return nil
+}
+
 // shouldSkipQuery checks if the query should be skipped.
 func (f *Function) shouldSkipQuery(req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
 	// Determine if we should skip the query when target has data
@@ -1103,222 +1825,126 @@ func (f *Function) shouldSkipQuery(req *fnv1.RunFunctionRequest, in *v1beta1.Inp
 		return false
 	}
 
-	switch {
-	case strings.HasPrefix(in.Target, "status."):
-		return f.checkStatusTargetHasData(req, in, rsp)
-	case strings.HasPrefix(in.Target, "context."):
-		return f.checkContextTargetHasData(req, in, rsp)
+	// Only skip the query when every target has data
+	for _, t := range resultTargets(in) {
+		hasData, err := f.checkTargetHasData(req, t.Target)
+		if err != nil {
+			response.Fatal(rsp, err)
+			return true
+		}
+		if !hasData {
+			return false
+		}
+		if in.MaxAge != nil && !f.targetIsFresh(req, in, t.Target) {
+			f.log.Debug("Target data is older than maxAge, querying", "target", t.Target, "maxAge", in.MaxAge.Duration)
+			return false
+		}
 	}
 
-	return false
-}
-
-// checkContextTargetHasData checks if the context target has data.
-func (f *Function) checkContextTargetHasData(req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
-	contextMap := req.GetContext().AsMap()
-	contextField := strings.TrimPrefix(in.Target, "context.")
-	if hasData, _ := targetHasData(contextMap, contextField); hasData {
-		f.log.Info("Target already has data, skipping query", "target", in.Target)
-
-		// Set success condition and return
-		response.ConditionTrue(rsp, "FunctionSkip", "SkippedQuery").
-			WithMessage("Target already has data, skipped query to avoid throttling").
-			TargetCompositeAndClaim()
-		return true
-	}
-	return false
+	f.log.Info("Target already has data, skipping query", "target", targetNames(in))
+	response.ConditionTrue(rsp, "FunctionSkip", "SkippedQuery").
+		WithMessage("Target already has data, skipped query to avoid throttling").
+		TargetCompositeAndClaim()
+	return true
 }
 
-// resolveGroupRef resolves the group name from a reference in spec, status or context.
-func (f *Function) resolveGroupRef(req *fnv1.RunFunctionRequest, groupRef *string) (string, error) {
-	if groupRef == nil || *groupRef == "" {
-		return "", errors.New("empty groupRef provided")
-	}
-
-	refKey := *groupRef
-
-	// Use a proper switch statement instead of if-else chain
+// checkTargetHasData checks if the target has data.
+func (f *Function) checkTargetHasData(req *fnv1.RunFunctionRequest, target string) (bool, error) {
 	switch {
-	case strings.HasPrefix(refKey, "status."):
-		return f.resolveFromStatus(req, refKey)
-	case strings.HasPrefix(refKey, "context."):
-		return f.resolveFromContext(req, refKey)
-	case strings.HasPrefix(refKey, "spec."):
-		return f.resolveFromSpec(req, refKey)
-	default:
-		return "", errors.Errorf("unsupported groupRef format: %s", refKey)
-	}
-}
-
-// resolveFromStatus resolves a reference from XR status
-func (f *Function) resolveFromStatus(req *fnv1.RunFunctionRequest, refKey string) (string, error) {
-	xrStatus, _, err := f.getXRAndStatus(req)
-	if err != nil {
-		return "", errors.Wrap(err, "cannot get XR status")
+	case strings.HasPrefix(target, "status."):
+		return f.checkStatusTargetHasData(req, target)
+	case strings.HasPrefix(target, "context."):
+		return f.checkContextTargetHasData(req, target), nil
+	case strings.HasPrefix(target, "resource."):
+		return checkResourceTargetHasData(req, target), nil
+	case strings.HasPrefix(target, "metadata."):
+		return checkMetadataTargetHasData(req, target), nil
 	}
 
-	statusField := strings.TrimPrefix(refKey, "status.")
-	value, ok := GetNestedKey(xrStatus, statusField)
-	if !ok {
-		return "", errors.Errorf("cannot resolve groupRef: %s not found", refKey)
-	}
-	return value, nil
+	return false, nil
 }
 
-// resolveFromContext resolves a reference from function context
-func (f *Function) resolveFromContext(req *fnv1.RunFunctionRequest, refKey string) (string, error) {
+// checkContextTargetHasData checks if the context target has data.
+func (f *Function) checkContextTargetHasData(req *fnv1.RunFunctionRequest, target string) bool {
 	contextMap := req.GetContext().AsMap()
-	contextField := strings.TrimPrefix(refKey, "context.")
-	value, ok := GetNestedKey(contextMap, contextField)
-	if !ok {
-		return "", errors.Errorf("cannot resolve groupRef: %s not found", refKey)
-	}
-	return value, nil
+	contextField := strings.TrimPrefix(target, "context.")
+	hasData, _ := targetHasData(contextMap, contextField)
+	return hasData
 }
 
-// resolveFromSpec resolves a reference from XR spec
-func (f *Function) resolveFromSpec(req *fnv1.RunFunctionRequest, refKey string) (string, error) {
-	// Use getXRAndStatus to ensure spec is copied to desired XR
-	_, dxr, err := f.getXRAndStatus(req)
-	if err != nil {
-		return "", errors.Wrap(err, "cannot get XR status and desired XR")
+// resolveGroupRef resolves the group name from a reference expression.
+func (f *Function) resolveGroupRef(req *fnv1.RunFunctionRequest, in *v1beta1.Input, groupRef *string) (string, error) {
+	if groupRef == nil || *groupRef == "" {
+		return "", errors.New("empty groupRef provided")
 	}
 
-	// Get spec from the desired XR (which now has the spec copied from observed)
-	xrSpec := make(map[string]interface{})
-	err = dxr.Resource.GetValueInto("spec", &xrSpec)
+	view, err := f.referenceView(req, in)
 	if err != nil {
-		return "", errors.Wrap(err, "cannot get XR spec")
-	}
-
-	specField := strings.TrimPrefix(refKey, "spec.")
-	value, ok := GetNestedKey(xrSpec, specField)
-	if !ok {
-		return "", errors.Errorf("cannot resolve groupRef: %s not found", refKey)
+		return "", err
 	}
-	return value, nil
+	return resolveRefString(view, *groupRef, "groupRef")
 }
 
-// resolveStringArrayRef resolves a list of string values from a reference in spec, status or context
-func (f *Function) resolveStringArrayRef(req *fnv1.RunFunctionRequest, ref *string, refType string) ([]*string, error) {
+// resolveStringArrayRef resolves a list of string values from a reference expression. Several
+// references joined with " + " resolve to the values of every reference, in order.
+func (f *Function) resolveStringArrayRef(req *fnv1.RunFunctionRequest, in *v1beta1.Input, ref *string, refType string) ([]*string, error) {
 	if ref == nil || *ref == "" {
 		return nil, errors.Errorf("empty %s provided", refType)
 	}
 
-	refKey := *ref
-
-	var (
-		result []*string
-		err    error
-	)
-
-	// Use proper switch statement instead of if-else chain
-	switch {
-	case strings.HasPrefix(refKey, "status."):
-		result, err = f.resolveStringArrayFromStatus(req, refKey)
-	case strings.HasPrefix(refKey, "context."):
-		result, err = f.resolveStringArrayFromContext(req, refKey)
-	case strings.HasPrefix(refKey, "spec."):
-		result, err = f.resolveStringArrayFromSpec(req, refKey)
-	default:
-		return nil, errors.Errorf("unsupported %s format: %s", refType, refKey)
+	view, err := f.referenceView(req, in)
+	if err != nil {
+		return nil, err
 	}
 
-	// If we got an error and it contains "groupsRef" but we're looking for a different ref type,
-	// replace it with the correct ref type
-	if err != nil && refType != "groupsRef" && strings.Contains(err.Error(), "groupsRef") {
-		errMsg := err.Error()
-		return nil, errors.New(strings.ReplaceAll(errMsg, "groupsRef", refType))
+	var result []*string
+	for _, part := range refParts(*ref) {
+		values, err := f.resolveRefStrings(view, part, refType)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, values...)
 	}
-
-	return result, err
+	return result, nil
 }
 
-// resolveStringArrayFromStatus resolves a list of string values from XR status
-func (f *Function) resolveStringArrayFromStatus(req *fnv1.RunFunctionRequest, refKey string) ([]*string, error) {
-	xrStatus, _, err := f.getXRAndStatus(req)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot get XR status")
-	}
+// resolveGroupsRef resolves a list of group names from a reference expression
+func (f *Function) resolveGroupsRef(req *fnv1.RunFunctionRequest, in *v1beta1.Input, groupsRef *string) ([]*string, error) {
+	return f.resolveStringArrayRef(req, in, groupsRef, "groupsRef")
+}
 
-	statusField := strings.TrimPrefix(refKey, "status.")
-	return f.extractStringArrayFromMap(xrStatus, statusField, refKey)
+// resolveUsersRef resolves a list of user names from a reference expression
+func (f *Function) resolveUsersRef(req *fnv1.RunFunctionRequest, in *v1beta1.Input, usersRef *string) ([]*string, error) {
+	return f.resolveStringArrayRef(req, in, usersRef, "usersRef")
 }
 
-// resolveStringArrayFromContext resolves a list of string values from function context
-func (f *Function) resolveStringArrayFromContext(req *fnv1.RunFunctionRequest, refKey string) ([]*string, error) {
-	contextMap := req.GetContext().AsMap()
-	contextField := strings.TrimPrefix(refKey, "context.")
-	return f.extractStringArrayFromMap(contextMap, contextField, refKey)
+// resolveServicePrincipalsRef resolves a list of service principal names from a reference expression
+func (f *Function) resolveServicePrincipalsRef(req *fnv1.RunFunctionRequest, in *v1beta1.Input, servicePrincipalsRef *string) ([]*string, error) {
+	return f.resolveStringArrayRef(req, in, servicePrincipalsRef, "servicePrincipalsRef")
 }
 
-// resolveStringArrayFromSpec resolves a list of string values from XR spec
-func (f *Function) resolveStringArrayFromSpec(req *fnv1.RunFunctionRequest, refKey string) ([]*string, error) {
-	// Use getXRAndStatus to ensure spec is copied to desired XR
-	_, dxr, err := f.getXRAndStatus(req)
+// extractStringArrayFromMap extracts a string array from a map using a path, which may select
+// a field of every element of a list of objects with [*] or [?field==value], e.g. spec.members[*].email
+func (f *Function) extractStringArrayFromMap(dataMap map[string]interface{}, field, refKey, refType string) ([]*string, error) {
+	segments, err := parsePath(field)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot get XR status and desired XR")
+		return nil, errors.Wrapf(err, "cannot resolve %s: invalid path", refType)
 	}
 
-	// Get spec from the desired XR (which now has the spec copied from observed)
-	xrSpec := make(map[string]interface{})
-	err = dxr.Resource.GetValueInto("spec", &xrSpec)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot get XR spec")
+	if selectsMissingField(dataMap, segments) {
+		return nil, errors.Errorf("cannot resolve %s: %s not found", refType, refKey)
 	}
-
-	specField := strings.TrimPrefix(refKey, "spec.")
-	return f.extractStringArrayFromMap(xrSpec, specField, refKey)
-}
-
-// resolveGroupsRef resolves a list of group names from a reference in status or context
-func (f *Function) resolveGroupsRef(req *fnv1.RunFunctionRequest, groupsRef *string) ([]*string, error) {
-	return f.resolveStringArrayRef(req, groupsRef, "groupsRef")
-}
-
-// resolveUsersRef resolves a list of user names from a reference in status or context
-func (f *Function) resolveUsersRef(req *fnv1.RunFunctionRequest, usersRef *string) ([]*string, error) {
-	return f.resolveStringArrayRef(req, usersRef, "usersRef")
-}
-
-// resolveServicePrincipalsRef resolves a list of service principal names from a reference in status or context
-func (f *Function) resolveServicePrincipalsRef(req *fnv1.RunFunctionRequest, servicePrincipalsRef *string) ([]*string, error) {
-	return f.resolveStringArrayRef(req, servicePrincipalsRef, "servicePrincipalsRef")
-}
-
-// extractStringArrayFromMap extracts a string array from a map using nested key
-func (f *Function) extractStringArrayFromMap(dataMap map[string]interface{}, field, refKey string) ([]*string, error) {
-	parts, err := ParseNestedKey(field)
+	value, err := evaluateSegments(dataMap, segments)
 	if err != nil {
-		return nil, errors.Wrap(err, "invalid field key")
+		return nil, errors.Wrapf(err, "cannot resolve %s: %s", refType, refKey)
 	}
 
-	currentValue := interface{}(dataMap)
-	for _, k := range parts {
-		if nestedMap, ok := currentValue.(map[string]interface{}); ok {
-			if nextValue, exists := nestedMap[k]; exists {
-				currentValue = nextValue
-			} else {
-				return nil, errors.Errorf("cannot resolve groupsRef: %s not found", refKey)
-			}
-		} else {
-			return nil, errors.Errorf("cannot resolve groupsRef: %s not a map", refKey)
-		}
+	values, err := pathStrings(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot resolve %s: %s", refType, refKey)
 	}
-
-	// The current value should be a slice of strings
-	if strArray, ok := currentValue.([]interface{}); ok {
-		result := make([]*string, 0, len(strArray))
-		for _, val := range strArray {
-			if strVal, ok := val.(string); ok {
-				strCopy := strVal // Create a new string to avoid pointing to a loop variable
-				result = append(result, &strCopy)
-			}
-		}
-		if len(result) > 0 {
-			return result, nil
-		}
+	if len(values) == 0 {
+		return nil, errors.Errorf("cannot resolve %s: %s selects no values", refType, refKey)
 	}
-
-	return nil, errors.Errorf("cannot resolve groupsRef: %s not a string array or empty", refKey)
+	return values, nil
 }
@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/upbound/function-msgraph/input/v1beta1"
@@ -14,6 +18,7 @@ import (
 
 	"github.com/crossplane/crossplane-runtime/pkg/errors"
 	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
 	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
 	"github.com/crossplane/function-sdk-go/resource"
 	"github.com/crossplane/function-sdk-go/response"
@@ -507,18 +512,18 @@ func TestResolveGroupRef(t *testing.T) {
 										"name": "Developers"
 									},
 									"groupMembers": [
+										{
+											"id": "sp-id-1",
+											"displayName": "Test Service Principal",
+											"appId": "sp-app-id-1",
+											"type": "servicePrincipal"
+										},
 										{
 											"id": "user-id-1",
 											"displayName": "Test User 1",
 											"mail": "user1@example.com",
 											"type": "user",
 											"userPrincipalName": "user1@example.com"
-										},
-										{
-											"id": "sp-id-1",
-											"displayName": "Test Service Principal",
-											"appId": "sp-app-id-1",
-											"type": "servicePrincipal"
 										}
 									]
 								}}`),
@@ -593,18 +598,18 @@ func TestResolveGroupRef(t *testing.T) {
 								},
 								"status": {
 									"groupMembers": [
+										{
+											"id": "sp-id-1",
+											"displayName": "Test Service Principal",
+											"appId": "sp-app-id-1",
+											"type": "servicePrincipal"
+										},
 										{
 											"id": "user-id-1",
 											"displayName": "Test User 1",
 											"mail": "user1@example.com",
 											"type": "user",
 											"userPrincipalName": "user1@example.com"
-										},
-										{
-											"id": "sp-id-1",
-											"displayName": "Test Service Principal",
-											"appId": "sp-app-id-1",
-											"type": "servicePrincipal"
 										}
 									]
 								}}`),
@@ -676,18 +681,18 @@ func TestResolveGroupRef(t *testing.T) {
 								},
 								"status": {
 									"groupMembers": [
+										{
+											"id": "sp-id-1",
+											"displayName": "Test Service Principal",
+											"appId": "sp-app-id-1",
+											"type": "servicePrincipal"
+										},
 										{
 											"id": "user-id-1",
 											"displayName": "Test User 1",
 											"mail": "user1@example.com",
 											"type": "user",
 											"userPrincipalName": "user1@example.com"
-										},
-										{
-											"id": "sp-id-1",
-											"displayName": "Test Service Principal",
-											"appId": "sp-app-id-1",
-											"type": "servicePrincipal"
 										}
 									]
 								}}`),
@@ -883,6 +888,12 @@ func TestResolveUsersRef(t *testing.T) {
 								"status": {
 									"users": ["user1@example.com", "user2@example.com", "admin@example.onmicrosoft.com"],
 									"validatedUsers": [
+										{
+											"id": "admin-id",
+											"displayName": "Admin User",
+											"userPrincipalName": "admin@example.onmicrosoft.com",
+											"mail": "admin@example.onmicrosoft.com"
+										},
 										{
 											"id": "user-id-1",
 											"displayName": "User 1",
@@ -894,12 +905,6 @@ func TestResolveUsersRef(t *testing.T) {
 											"displayName": "User 2",
 											"userPrincipalName": "user2@example.com",
 											"mail": "user2@example.com"
-										},
-										{
-											"id": "admin-id",
-											"displayName": "Admin User",
-											"userPrincipalName": "admin@example.onmicrosoft.com",
-											"mail": "admin@example.onmicrosoft.com"
 										}
 									]
 								}}`),
@@ -970,6 +975,12 @@ func TestResolveUsersRef(t *testing.T) {
 								},
 								"status": {
 									"validatedUsers": [
+										{
+											"id": "admin-id",
+											"displayName": "Admin User",
+											"userPrincipalName": "admin@example.onmicrosoft.com",
+											"mail": "admin@example.onmicrosoft.com"
+										},
 										{
 											"id": "user-id-1",
 											"displayName": "User 1",
@@ -981,12 +992,6 @@ func TestResolveUsersRef(t *testing.T) {
 											"displayName": "User 2",
 											"userPrincipalName": "user2@example.com",
 											"mail": "user2@example.com"
-										},
-										{
-											"id": "admin-id",
-											"displayName": "Admin User",
-											"userPrincipalName": "admin@example.onmicrosoft.com",
-											"mail": "admin@example.onmicrosoft.com"
 										}
 									]
 								}}`),
@@ -1058,6 +1063,12 @@ func TestResolveUsersRef(t *testing.T) {
 								},
 								"status": {
 									"validatedUsers": [
+										{
+											"id": "admin-id",
+											"displayName": "Admin User",
+											"userPrincipalName": "admin@example.onmicrosoft.com",
+											"mail": "admin@example.onmicrosoft.com"
+										},
 										{
 											"id": "user-id-1",
 											"displayName": "User 1",
@@ -1069,12 +1080,6 @@ func TestResolveUsersRef(t *testing.T) {
 											"displayName": "User 2",
 											"userPrincipalName": "user2@example.com",
 											"mail": "user2@example.com"
-										},
-										{
-											"id": "admin-id",
-											"displayName": "Admin User",
-											"userPrincipalName": "admin@example.onmicrosoft.com",
-											"mail": "admin@example.onmicrosoft.com"
 										}
 									]
 								}}`),
@@ -1949,18 +1954,18 @@ func TestRunFunction(t *testing.T) {
 								},
 								"status": {
 									"groupMembers": [
+										{
+											"id": "sp-id-1",
+											"displayName": "Test Service Principal",
+											"appId": "sp-app-id-1",
+											"type": "servicePrincipal"
+										},
 										{
 											"id": "user-id-1",
 											"displayName": "Test User 1",
 											"mail": "user1@example.com",
 											"type": "user",
 											"userPrincipalName": "user1@example.com"
-										},
-										{
-											"id": "sp-id-1",
-											"displayName": "Test Service Principal",
-											"appId": "sp-app-id-1",
-											"type": "servicePrincipal"
 										}
 									]
 								}}`),
@@ -2633,6 +2638,170 @@ func TestIdentityType(t *testing.T) {
 				},
 			},
 		},
+		"AzureManagedIdentityCredentialsWithoutCredentials": {
+			reason: "The Function should not require azure-creds credentials if identity.type is AzureManagedIdentityCredentials",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groupsRef": "status.groups",
+						"target": "status.groupObjectIDs",
+						"identity": {
+							"type": "AzureManagedIdentityCredentials",
+							"managedIdentityClientId": "test-managed-identity-client-id"
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"status": {
+									"groups": ["Developers", "Operations", "All Company"],
+									"groupObjectIDs": [
+										{
+											"id": "group-id-1",
+											"displayName": "Developers"
+										}
+									]
+								}}`),
+						},
+					},
+				},
+			},
+		},
+		"AzureDefaultCredentialsReportsCredential": {
+			reason: "The Function should report which credential authenticated if identity.type is AzureDefaultCredentials",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groupsRef": "status.groups",
+						"target": "status.groupObjectIDs",
+						"identity": {
+							"type": "AzureDefaultCredentials"
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "Authenticated using AzureWorkloadIdentityCredentials",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"status": {
+									"groups": ["Developers", "Operations", "All Company"],
+									"groupObjectIDs": [
+										{
+											"id": "group-id-1",
+											"displayName": "Developers"
+										}
+									]
+								}}`),
+						},
+					},
+				},
+			},
+		},
+		"MissingCredentialsForServicePrincipal": {
+			reason: "The Function should require azure-creds credentials if identity.type is AzureServicePrincipalCredentials",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groupsRef": "status.groups",
+						"target": "status.groupObjectIDs"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  `failed to get azure-creds credentials`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
 		"AzureWorkloadIdentityCredentials": {
 			reason: "The Function should use Workload Identity credentials if identity.type is AzureWorkloadIdentityCredentials",
 			args: args{
@@ -2684,7 +2853,7 @@ func TestIdentityType(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			// Create mock responders for each type of query
 			mockQuery := &MockGraphQuery{
-				GraphQueryFunc: func(_ context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
+				GraphQueryFunc: func(ctx context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
 					identityType := v1beta1.IdentityTypeAzureServicePrincipalCredentials
 
 					if in.Identity != nil && in.Identity.Type != "" {
@@ -2696,6 +2865,21 @@ func TestIdentityType(t *testing.T) {
 						return nil, errors.New("failed to initialize workload identity provider: failed to obtain workloadidentity credentials")
 					case v1beta1.IdentityTypeAzureServicePrincipalCredentials:
 						return nil, errors.New("failed to initialize service principal provider: failed to obtain clientsecret credentials")
+					case v1beta1.IdentityTypeAzureDefaultCredentials:
+						recordCredential(ctx, string(v1beta1.IdentityTypeAzureWorkloadIdentityCredentials))
+						return []interface{}{
+							map[string]interface{}{
+								"id":          "group-id-1",
+								"displayName": "Developers",
+							},
+						}, nil
+					case v1beta1.IdentityTypeAzureManagedIdentityCredentials:
+						return []interface{}{
+							map[string]interface{}{
+								"id":          "group-id-1",
+								"displayName": "Developers",
+							},
+						}, nil
 					default:
 						return nil, errors.Errorf("unsupported identity.type: %s", string(identityType))
 					}
@@ -2718,3 +2902,947 @@ func TestIdentityType(t *testing.T) {
 		})
 	}
 }
+
+func TestInitializeManagedIdentityProvider(t *testing.T) {
+	type args struct {
+		azureCreds map[string]string
+		identity   *v1beta1.Identity
+	}
+	type want struct {
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"SystemAssigned": {
+			reason: "The provider should use the system-assigned identity when no user-assigned identity is selected",
+			args: args{
+				identity: &v1beta1.Identity{Type: v1beta1.IdentityTypeAzureManagedIdentityCredentials},
+			},
+		},
+		"UserAssignedClientID": {
+			reason: "The provider should accept a user-assigned identity client id",
+			args: args{
+				identity: &v1beta1.Identity{
+					Type:                    v1beta1.IdentityTypeAzureManagedIdentityCredentials,
+					ManagedIdentityClientID: ptr.To("test-client-id"),
+				},
+			},
+		},
+		"UserAssignedResourceIDFromCredentials": {
+			reason: "The provider should accept a user-assigned identity resource id from credentials",
+			args: args{
+				azureCreds: map[string]string{
+					ManagedIdentityResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id",
+				},
+				identity: &v1beta1.Identity{Type: v1beta1.IdentityTypeAzureManagedIdentityCredentials},
+			},
+		},
+		"ClientIDAndResourceID": {
+			reason: "The provider should refuse both a client id and a resource id",
+			args: args{
+				identity: &v1beta1.Identity{
+					Type:                      v1beta1.IdentityTypeAzureManagedIdentityCredentials,
+					ManagedIdentityClientID:   ptr.To("test-client-id"),
+					ManagedIdentityResourceID: ptr.To("test-resource-id"),
+				},
+			},
+			want: want{
+				err: errors.New("only one of managed identity client id and resource id can be set"),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			g := &GraphQuery{log: logging.NewNopLogger()}
+			_, err := g.initializeManagedIdentityProvider(tc.args.azureCreds, tc.args.identity)
+
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\ng.initializeManagedIdentityProvider(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+type fakeTokenCredential struct {
+	token string
+	err   error
+	calls int
+}
+
+func (c *fakeTokenCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls++
+	if c.err != nil {
+		return azcore.AccessToken{}, c.err
+	}
+	return azcore.AccessToken{Token: c.token}, nil
+}
+
+func TestCredentialChain(t *testing.T) {
+	type want struct {
+		token      string
+		credential string
+		calls      []int
+		err        error
+	}
+
+	unavailable := func(context.Context) error { return errors.New("IMDS endpoint did not respond") }
+
+	cases := map[string]struct {
+		reason  string
+		sources []credentialSource
+		want    want
+	}{
+		"FirstAuthenticated": {
+			reason: "The first source which authenticates should produce the token and be recorded",
+			sources: []credentialSource{
+				{name: "AzureWorkloadIdentityCredentials", cred: &fakeTokenCredential{token: "workload"}},
+				{name: "AzureServicePrincipalCredentials", cred: &fakeTokenCredential{token: "secret"}},
+			},
+			want: want{
+				token:      "workload",
+				credential: "AzureWorkloadIdentityCredentials",
+				calls:      []int{1, 0},
+			},
+		},
+		"FallThroughFailure": {
+			reason: "A source which fails to authenticate should fall through to the next source",
+			sources: []credentialSource{
+				{name: "AzureWorkloadIdentityCredentials", cred: &fakeTokenCredential{err: errors.New("boom")}},
+				{name: "AzureServicePrincipalCredentials", cred: &fakeTokenCredential{token: "secret"}},
+			},
+			want: want{
+				token:      "secret",
+				credential: "AzureServicePrincipalCredentials",
+				calls:      []int{1, 1},
+			},
+		},
+		"FallThroughUnavailable": {
+			reason: "A source whose probe fails should be skipped without requesting a token",
+			sources: []credentialSource{
+				{name: "AzureManagedIdentityCredentials", cred: &fakeTokenCredential{token: "managed"}, probe: unavailable},
+				{name: "EnvironmentCredential", cred: &fakeTokenCredential{token: "environment"}},
+			},
+			want: want{
+				token:      "environment",
+				credential: "EnvironmentCredential",
+				calls:      []int{0, 1},
+			},
+		},
+		"AllFailed": {
+			reason: "The chain should fail listing every source when none authenticates",
+			sources: []credentialSource{
+				{name: "AzureManagedIdentityCredentials", cred: &fakeTokenCredential{token: "managed"}, probe: unavailable},
+				{name: "AzureServicePrincipalCredentials", cred: &fakeTokenCredential{err: errors.New("boom")}},
+			},
+			want: want{
+				calls: []int{0, 1},
+				err:   errors.New("no credential authenticated: AzureManagedIdentityCredentials: IMDS endpoint did not respond; AzureServicePrincipalCredentials: boom"),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, recorder := withCredentialRecorder(context.Background())
+			chain := &credentialChain{sources: tc.sources}
+			token, err := chain.GetToken(ctx, policy.TokenRequestOptions{Scopes: MSGraphScopes})
+
+			if diff := cmp.Diff(tc.want.token, token.Token); diff != "" {
+				t.Errorf("%s\nchain.GetToken(...): -want token, +got token:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.credential, recorder.credential()); diff != "" {
+				t.Errorf("%s\nrecorder.credential(): -want, +got:\n%s", tc.reason, diff)
+			}
+			calls := make([]int, 0, len(tc.sources))
+			for _, s := range tc.sources {
+				calls = append(calls, s.cred.(*fakeTokenCredential).calls)
+			}
+			if diff := cmp.Diff(tc.want.calls, calls); diff != "" {
+				t.Errorf("%s\nGetToken calls per source: -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nchain.GetToken(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestCredentialChainReusesSource(t *testing.T) {
+	failed := &fakeTokenCredential{err: errors.New("boom")}
+	secret := &fakeTokenCredential{token: "secret"}
+	chain := &credentialChain{sources: []credentialSource{
+		{name: "AzureWorkloadIdentityCredentials", cred: failed},
+		{name: "AzureServicePrincipalCredentials", cred: secret},
+	}}
+
+	for range 2 {
+		ctx, recorder := withCredentialRecorder(context.Background())
+		if _, err := chain.GetToken(ctx, policy.TokenRequestOptions{Scopes: MSGraphScopes}); err != nil {
+			t.Fatalf("chain.GetToken(...): %v", err)
+		}
+		if diff := cmp.Diff("AzureServicePrincipalCredentials", recorder.credential()); diff != "" {
+			t.Errorf("recorder.credential(): -want, +got:\n%s", diff)
+		}
+	}
+	if failed.calls != 1 || secret.calls != 2 {
+		t.Errorf("The chain should keep using the source which authenticated, got %d and %d calls", failed.calls, secret.calls)
+	}
+}
+
+func TestProbeIMDS(t *testing.T) {
+	t.Setenv("IDENTITY_ENDPOINT", "")
+	t.Setenv("MSI_ENDPOINT", "")
+
+	available := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer available.Close()
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailable.Close()
+
+	if err := probeIMDS(context.Background(), available.URL); err != nil {
+		t.Errorf("probeIMDS(...): an endpoint which responds should be available, got %v", err)
+	}
+	if err := probeIMDS(context.Background(), unavailable.URL); err == nil {
+		t.Errorf("probeIMDS(...): an endpoint which does not respond should be unavailable")
+	}
+}
+
+func TestGetCreds(t *testing.T) {
+	credentials := func(key string) *fnv1.Credentials {
+		return &fnv1.Credentials{
+			Source: &fnv1.Credentials_CredentialData{CredentialData: &fnv1.CredentialData{
+				Data: map[string][]byte{
+					key: []byte(`{"clientId": "test-client-id", "clientSecret": "test-client-secret", "tenantId": "test-tenant-id"}`),
+				},
+			}},
+		}
+	}
+	azureCreds := map[string]string{
+		ClientID:     "test-client-id",
+		ClientSecret: "test-client-secret",
+		TenantID:     "test-tenant-id",
+	}
+
+	type args struct {
+		req      *fnv1.RunFunctionRequest
+		identity *v1beta1.Identity
+	}
+	type want struct {
+		creds map[string]string
+		err   error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"DefaultCredentials": {
+			reason: "Credentials should be read from azure-creds by default",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Credentials: map[string]*fnv1.Credentials{"azure-creds": credentials("credentials")},
+				},
+			},
+			want: want{creds: azureCreds},
+		},
+		"NamedCredentials": {
+			reason: "Credentials should be read from the configured credentials name and key",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds":  credentials("credentials"),
+						"tenant-b-app": credentials("app.json"),
+					},
+				},
+				identity: &v1beta1.Identity{
+					CredentialsName: ptr.To("tenant-b-app"),
+					CredentialsKey:  ptr.To("app.json"),
+				},
+			},
+			want: want{creds: azureCreds},
+		},
+		"MissingNamedCredentials": {
+			reason: "Missing credentials should be reported by their configured name",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Credentials: map[string]*fnv1.Credentials{"azure-creds": credentials("credentials")},
+				},
+				identity: &v1beta1.Identity{CredentialsName: ptr.To("tenant-b-app")},
+			},
+			want: want{err: errors.New("failed to get tenant-b-app credentials")},
+		},
+		"OptionalCredentials": {
+			reason: "Missing credentials should be tolerated for managed identity",
+			args: args{
+				req:      &fnv1.RunFunctionRequest{},
+				identity: &v1beta1.Identity{Type: v1beta1.IdentityTypeAzureManagedIdentityCredentials},
+			},
+			want: want{creds: map[string]string{}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			creds, err := getCreds(tc.args.req, tc.args.identity)
+
+			if diff := cmp.Diff(tc.want.creds, creds); diff != "" {
+				t.Errorf("%s\ngetCreds(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\ngetCreds(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestTenantFanOut(t *testing.T) {
+	var (
+		xr       = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		appCreds = func(tenantID string) *fnv1.Credentials {
+			return &fnv1.Credentials{
+				Source: &fnv1.Credentials_CredentialData{CredentialData: &fnv1.CredentialData{
+					Data: map[string][]byte{
+						"credentials": []byte(fmt.Sprintf(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": %q
+}`, tenantID)),
+					},
+				}},
+			}
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"MergeTenantResults": {
+			reason: "The Function should run the query per tenant and store results under per-tenant keys",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "UserValidation",
+						"users": ["guest@example.com"],
+						"target": "status.validatedUsers",
+						"tenants": [
+							{
+								"name": "resource",
+								"identity": {"credentialsName": "resource-creds"}
+							},
+							{
+								"name": "home",
+								"tenantId": "home-tenant-id",
+								"identity": {"credentialsName": "resource-creds"}
+							}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"resource-creds": appCreds("resource-tenant-id"),
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "UserValidation"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"count": 2},
+								"status": {
+									"validatedUsers": {
+										"home": [
+											{"id": "home-tenant-id-user", "userPrincipalName": "guest@example.com"}
+										],
+										"resource": [
+											{"id": "resource-tenant-id-user", "userPrincipalName": "guest@example.com"}
+										]
+									}
+								}}`),
+						},
+					},
+				},
+			},
+		},
+		"AllowPartialTenantFailure": {
+			reason: "The Function should store successful tenant results and warn about failed tenants with AllowPartial",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "UserValidation",
+						"users": ["guest@example.com"],
+						"target": "status.validatedUsers",
+						"tenantFailurePolicy": "AllowPartial",
+						"tenants": [
+							{"name": "resource"},
+							{"name": "broken", "tenantId": "broken-tenant-id"}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": appCreds("resource-tenant-id"),
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "query failed for tenant broken: tenant not found",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "UserValidation"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"count": 2},
+								"status": {
+									"validatedUsers": {
+										"resource": [
+											{"id": "resource-tenant-id-user", "userPrincipalName": "guest@example.com"}
+										]
+									}
+								}}`),
+						},
+					},
+				},
+			},
+		},
+		"FailFastTenantFailure": {
+			reason: "The Function should fail when a tenant query fails by default",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "UserValidation",
+						"users": ["guest@example.com"],
+						"target": "status.validatedUsers",
+						"tenants": [
+							{"name": "broken", "tenantId": "broken-tenant-id"},
+							{"name": "resource"}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": appCreds("resource-tenant-id"),
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "query failed for tenant broken: tenant not found",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"DuplicateTenantName": {
+			reason: "The Function should refuse duplicate tenant names",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "UserValidation",
+						"users": ["guest@example.com"],
+						"target": "status.validatedUsers",
+						"tenants": [
+							{"name": "resource"},
+							{"name": "resource", "tenantId": "home-tenant-id"}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": appCreds("resource-tenant-id"),
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "tenants[1]: duplicate tenant name resource",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, azureCreds map[string]string, in *v1beta1.Input) (interface{}, error) {
+					if azureCreds[TenantID] == "broken-tenant-id" {
+						return nil, errors.New("tenant not found")
+					}
+					results := make([]interface{}, 0, len(in.Users))
+					for _, user := range in.Users {
+						results = append(results, map[string]interface{}{
+							"id":                azureCreds[TenantID] + "-user",
+							"userPrincipalName": *user,
+						})
+					}
+					return results, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestTenantIdentity(t *testing.T) {
+	type args struct {
+		in     *v1beta1.Input
+		tenant v1beta1.Tenant
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   *v1beta1.Identity
+	}{
+		"InputIdentity": {
+			reason: "A tenant without an identity should use the identity of the input",
+			args: args{
+				in:     &v1beta1.Input{Identity: &v1beta1.Identity{Type: v1beta1.IdentityTypeAzureManagedIdentityCredentials}},
+				tenant: v1beta1.Tenant{Name: "home"},
+			},
+			want: &v1beta1.Identity{Type: v1beta1.IdentityTypeAzureManagedIdentityCredentials},
+		},
+		"OverrideCredentialsName": {
+			reason: "A tenant overriding only the credentials name should keep the other fields of the input identity",
+			args: args{
+				in: &v1beta1.Input{Identity: &v1beta1.Identity{
+					Type:                    v1beta1.IdentityTypeAzureWorkloadIdentityCredentials,
+					CredentialsKey:          ptr.To("creds"),
+					ManagedIdentityClientID: ptr.To("client-id"),
+				}},
+				tenant: v1beta1.Tenant{Name: "home", Identity: &v1beta1.Identity{CredentialsName: ptr.To("home-creds")}},
+			},
+			want: &v1beta1.Identity{
+				Type:                    v1beta1.IdentityTypeAzureWorkloadIdentityCredentials,
+				CredentialsName:         ptr.To("home-creds"),
+				CredentialsKey:          ptr.To("creds"),
+				ManagedIdentityClientID: ptr.To("client-id"),
+			},
+		},
+		"OverrideType": {
+			reason: "A tenant should override the fields it sets",
+			args: args{
+				in: &v1beta1.Input{Identity: &v1beta1.Identity{
+					Type:            v1beta1.IdentityTypeAzureWorkloadIdentityCredentials,
+					CredentialsName: ptr.To("creds"),
+				}},
+				tenant: v1beta1.Tenant{Name: "home", Identity: &v1beta1.Identity{Type: v1beta1.IdentityTypeAzureServicePrincipalCredentials}},
+			},
+			want: &v1beta1.Identity{
+				Type:            v1beta1.IdentityTypeAzureServicePrincipalCredentials,
+				CredentialsName: ptr.To("creds"),
+			},
+		},
+		"NoInputIdentity": {
+			reason: "A tenant identity should be used as is when the input has no identity",
+			args: args{
+				in:     &v1beta1.Input{},
+				tenant: v1beta1.Tenant{Name: "home", Identity: &v1beta1.Identity{CredentialsName: ptr.To("home-creds")}},
+			},
+			want: &v1beta1.Identity{CredentialsName: ptr.To("home-creds")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := tenantIdentity(tc.args.in, tc.args.tenant)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\ntenantIdentity(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestValidateCreds(t *testing.T) {
+	type args struct {
+		azureCreds map[string]string
+		identity   *v1beta1.Identity
+	}
+	type want struct {
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"ValidServicePrincipal": {
+			reason: "Complete service principal credentials should be valid",
+			args: args{
+				azureCreds: map[string]string{TenantID: "tenant", ClientID: "client", ClientSecret: "secret"},
+			},
+		},
+		"MissingClientSecret": {
+			reason: "Service principal credentials without clientSecret should be invalid",
+			args: args{
+				azureCreds: map[string]string{TenantID: "tenant", ClientID: "client"},
+				identity:   &v1beta1.Identity{Type: v1beta1.IdentityTypeAzureServicePrincipalCredentials},
+			},
+			want: want{err: errors.New("missing clientSecret for AzureServicePrincipalCredentials")},
+		},
+		"MissingTenantAndClientSecret": {
+			reason: "Every missing key should be reported",
+			args: args{
+				azureCreds: map[string]string{ClientID: "client"},
+			},
+			want: want{err: errors.New("missing tenantId, clientSecret for AzureServicePrincipalCredentials")},
+		},
+		"MissingFederatedTokenFile": {
+			reason: "Workload identity credentials without federatedTokenFile should be invalid",
+			args: args{
+				azureCreds: map[string]string{},
+				identity:   &v1beta1.Identity{Type: v1beta1.IdentityTypeAzureWorkloadIdentityCredentials},
+			},
+			want: want{err: errors.New("missing federatedTokenFile for AzureWorkloadIdentityCredentials")},
+		},
+		"ManagedIdentityClientAndResourceID": {
+			reason: "Managed identity should not select both a client id and a resource id",
+			args: args{
+				azureCreds: map[string]string{ManagedIdentityResourceID: "resource"},
+				identity: &v1beta1.Identity{
+					Type:                    v1beta1.IdentityTypeAzureManagedIdentityCredentials,
+					ManagedIdentityClientID: ptr.To("client"),
+				},
+			},
+			want: want{err: errors.New("only one of managed identity client id and resource id can be set for AzureManagedIdentityCredentials")},
+		},
+		"DefaultCredentials": {
+			reason: "Default credentials should not require any key",
+			args: args{
+				identity: &v1beta1.Identity{Type: v1beta1.IdentityTypeAzureDefaultCredentials},
+			},
+		},
+		"UnsupportedIdentityType": {
+			reason: "Unsupported identity types should be invalid",
+			args: args{
+				identity: &v1beta1.Identity{Type: "AzureCertificateCredentials"},
+			},
+			want: want{err: errors.New("unsupported identity.type: AzureCertificateCredentials")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("AZURE_FEDERATED_TOKEN_FILE", "")
+			err := validateCreds(tc.args.azureCreds, tc.args.identity)
+
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nvalidateCreds(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestCredentialErrors(t *testing.T) {
+	var (
+		xr    = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		input = resource.MustStructJSON(`{
+			"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+			"kind": "Input",
+			"queryType": "UserValidation",
+			"users": ["user@example.com"],
+			"target": "status.validatedUsers"
+		}`)
+		credentials = func(j string) map[string]*fnv1.Credentials {
+			return map[string]*fnv1.Credentials{
+				"azure-creds": {
+					Source: &fnv1.Credentials_CredentialData{CredentialData: &fnv1.CredentialData{
+						Data: map[string][]byte{"credentials": []byte(j)},
+					}},
+				},
+			}
+		}
+	)
+
+	type args struct {
+		ctx      context.Context
+		req      *fnv1.RunFunctionRequest
+		queryErr error
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"MissingClientSecret": {
+			reason: "The Function should report incomplete credentials before querying",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta:  &fnv1.RequestMeta{Tag: "hello"},
+					Input: input,
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: credentials(`{"clientId": "test-client-id", "tenantId": "test-tenant-id"}`),
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "InvalidCredentials",
+							Message: ptr.To("missing clientSecret for AzureServicePrincipalCredentials"),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "missing clientSecret for AzureServicePrincipalCredentials",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"InvalidClientSecret": {
+			reason: "The Function should map AADSTS7000215 to the InvalidClientSecret reason",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta:  &fnv1.RequestMeta{Tag: "hello"},
+					Input: input,
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: credentials(`{"clientId": "test-client-id", "clientSecret": "wrong", "tenantId": "test-tenant-id"}`),
+				},
+				queryErr: errors.New("failed to validate user user@example.com: ClientSecretCredential authentication failed: AADSTS7000215: Invalid client secret provided."),
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "InvalidClientSecret",
+							Message: ptr.To("AADSTS7000215: the client secret is invalid, check clientSecret in the credentials"),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "failed to validate user user@example.com: ClientSecretCredential authentication failed: AADSTS7000215: Invalid client secret provided.",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"ConsentRequired": {
+			reason: "The Function should map AADSTS65001 to the ConsentRequired reason",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta:  &fnv1.RequestMeta{Tag: "hello"},
+					Input: input,
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: credentials(`{"clientId": "test-client-id", "clientSecret": "test-client-secret", "tenantId": "test-tenant-id"}`),
+				},
+				queryErr: errors.New("AADSTS65001: The user or administrator has not consented to use the application."),
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSuccess",
+							Status:  fnv1.Status_STATUS_CONDITION_FALSE,
+							Reason:  "ConsentRequired",
+							Message: ptr.To("AADSTS65001: admin consent for the Microsoft Graph API permissions has not been granted"),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "AADSTS65001: The user or administrator has not consented to use the application.",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, _ *v1beta1.Input) (interface{}, error) {
+					return nil, tc.args.queryErr
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
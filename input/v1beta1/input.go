@@ -6,6 +6,7 @@ package v1beta1
 
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // This isn't a custom resource, in the sense that we never install its CRD.
@@ -19,15 +20,103 @@ type Input struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
+	// Query is the query performed by this function step.
+	// Must not be set when Queries is used
+	Query `json:",inline"`
+
+	// Queries is a list of queries performed by this function step.
+	// The queries share credentials and a Graph client and run concurrently
+	// +optional
+	Queries []Query `json:"queries,omitempty"`
+
+	// Identity defines the type of identity used for authentication to the Microsoft Graph API.
+	Identity *Identity `json:"identity,omitempty"`
+
+	// Tenants runs the same query against each of the listed tenants.
+	// Results are stored in the Target as a map keyed by tenant name
+	// +optional
+	Tenants []Tenant `json:"tenants,omitempty"`
+
+	// TenantFailurePolicy controls how failed tenant queries are handled
+	// Supported values: FailFast, AllowPartial. Default is FailFast
+	// +optional
+	TenantFailurePolicy *TenantFailurePolicy `json:"tenantFailurePolicy,omitempty"`
+
+	// ExtraResources are Kubernetes objects requested from Crossplane, which references
+	// of the form extraResource.<name>.<path> resolve values from
+	// +optional
+	ExtraResources []ExtraResource `json:"extraResources,omitempty"`
+
+	// FieldRefs set fields of the input from reference expressions before the input is used,
+	// keyed by the path of the field, e.g. identity.type: spec.identityType or target: spec.target.
+	// Templates set strings, paths set the value they select
+	// +optional
+	FieldRefs map[string]string `json:"fieldRefs,omitempty"`
+}
+
+// ExtraResource selects Kubernetes objects, such as EnvironmentConfigs, to resolve references from.
+type ExtraResource struct {
+	// Name identifies the selected objects in extraResource.<name>.<path> references
+	Name string `json:"name"`
+
+	// APIVersion of the objects to select
+	APIVersion string `json:"apiVersion"`
+
+	// Kind of the objects to select
+	Kind string `json:"kind"`
+
+	// MatchName selects the object with this name. Either MatchName or MatchLabels must be set
+	// +optional
+	MatchName *string `json:"matchName,omitempty"`
+
+	// MatchLabels selects the objects with these labels. References resolve them to a list of objects,
+	// however many match
+	// +optional
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+}
+
+// Tenant defines a tenant a query is fanned out to.
+type Tenant struct {
+	// Name is the key under which the results of this tenant are stored
+	Name string `json:"name"`
+
+	// TenantID overrides the tenant id of the credentials, e.g. to query the
+	// home tenant of guest users with a multi-tenant app registration
+	// +optional
+	TenantID *string `json:"tenantId,omitempty"`
+
+	// Identity used to authenticate to this tenant. Its fields override those of the Identity of the Input
+	// +optional
+	Identity *Identity `json:"identity,omitempty"`
+}
+
+const (
+	// TenantFailurePolicyFailFast fails the function when a query fails for any tenant
+	TenantFailurePolicyFailFast TenantFailurePolicy = "FailFast"
+	// TenantFailurePolicyAllowPartial stores the results of successful tenants and reports failed tenants as warnings
+	TenantFailurePolicyAllowPartial TenantFailurePolicy = "AllowPartial"
+)
+
+// TenantFailurePolicy controls how failed tenant queries are handled.
+// Supported values: FailFast;AllowPartial
+type TenantFailurePolicy string
+
+// Query defines a Microsoft Graph API query and where to store its result.
+type Query struct {
+	// Name identifies the query in results of queries performed in one function step
+	// +optional
+	Name string `json:"name,omitempty"`
+
 	// QueryType defines the type of Microsoft Graph API query to perform
-	// Supported values: UserValidation, GroupMembership, GroupObjectIDs, ServicePrincipalDetails
-	QueryType string `json:"queryType"`
+	// Supported values: UserValidation, GroupMembership, GroupMembershipDrift, GroupObjectIDs, ServicePrincipalDetails
+	// +optional
+	QueryType string `json:"queryType,omitempty"`
 
 	// Users is a list of userPrincipalName (email IDs) for user validation
 	// +optional
 	Users []*string `json:"users,omitempty"`
 
-	// UsersRef is a reference to retrieve the user names (e.g., from status or context)
+	// UsersRef is a reference expression to retrieve the user names, paths or templates joined with " + "
 	// Overrides Users field if used
 	// +optional
 	UsersRef *string `json:"usersRef,omitempty"`
@@ -36,7 +125,7 @@ type Input struct {
 	// +optional
 	Groups []*string `json:"groups,omitempty"`
 
-	// GroupsRef is a reference to retrieve the group names (e.g., from status or context)
+	// GroupsRef is a reference expression to retrieve the group names, paths or templates joined with " + "
 	// Overrides Groups field if used
 	// +optional
 	GroupsRef *string `json:"groupsRef,omitempty"`
@@ -45,36 +134,270 @@ type Input struct {
 	// +optional
 	Group *string `json:"group,omitempty"`
 
-	// GroupRef is a reference to retrieve the group name (e.g., from status or context)
+	// GroupRef is a reference expression to retrieve the group name, a path or a template
 	// Overrides Group field if used
 	// +optional
 	GroupRef *string `json:"groupRef,omitempty"`
 
+	// Members is the declared list of members of the group for group membership drift queries.
+	// Members are matched by userPrincipalName, mail, displayName, appId or object ID
+	// +optional
+	Members []*string `json:"members,omitempty"`
+
+	// MembersRef is a reference expression to retrieve the declared members, paths or templates joined with " + "
+	// Overrides Members field if used
+	// +optional
+	MembersRef *string `json:"membersRef,omitempty"`
+
 	// ServicePrincipals is a list of service principal names
 	// +optional
 	ServicePrincipals []*string `json:"servicePrincipals,omitempty"`
 
-	// ServicePrincipalsRef is a reference to retrieve the service principal names (e.g., from status or context)
+	// ServicePrincipalsRef is a reference expression to retrieve the service principal names, paths or templates joined with " + "
 	// Overrides ServicePrincipals field if used
 	// +optional
 	ServicePrincipalsRef *string `json:"servicePrincipalsRef,omitempty"`
 
+	// FromQuery is a path into the results of another named query of Input.Queries
+	// (e.g., members[*].id) providing the users, groups, group or service principals of the query.
+	// The query runs after the query it references. Overrides the fields above if used
+	// +optional
+	FromQuery *string `json:"fromQuery,omitempty"`
+
+	// SortBy is a path within each query result (e.g. displayName) by which the results are sorted
+	// before they are stored, so that unchanged results are stored identically. Default is id
+	// +optional
+	SortBy *string `json:"sortBy,omitempty"`
+
+	// Transform is an expression applied to the query result before it is stored in the target.
+	// Either a path such as [*].id, or a map such as {userPrincipalName: id} built from a list of results
+	// +optional
+	Transform *string `json:"transform,omitempty"`
+
+	// OutputFormat controls whether the query results are stored as a list, or as a map keyed by
+	// the name the results were queried by (e.g. userPrincipalName or displayName) or by object ID.
+	// Supported values: list, mapByName, mapById. Default is list
+	// +optional
+	OutputFormat *OutputFormat `json:"outputFormat,omitempty"`
+
+	// MergeStrategy controls how the query results are combined with data written to a status or
+	// context target earlier in the same pipeline run, never with the observed status. Lists are deduplicated by object ID with union and mergeByKey.
+	// Supported values: replace, append, union, mergeByKey. Default is replace
+	// +optional
+	MergeStrategy *MergeStrategy `json:"mergeStrategy,omitempty"`
+
+	// Envelope stores the query results in a status or context target along with when and how
+	// they were fetched: {data, fetchedAt, changedAt, queryType, tenantId, resultHash, apiVersion}.
+	// fetchedAt is the time of the last query, changedAt the time the data last changed
+	// +optional
+	Envelope *bool `json:"envelope,omitempty"`
+
 	// Target where to store the Query Result
-	Target string `json:"target"`
+	// +optional
+	Target string `json:"target,omitempty"`
+
+	// Targets stores the Query Result in several targets, each with an optional transform.
+	// Can be combined with Target
+	// +optional
+	Targets []ResultTarget `json:"targets,omitempty"`
 
 	// SkipQueryWhenTargetHasData controls whether to skip the query when the target already has data
 	// Default is false to ensure continuous reconciliation
 	// +optional
 	SkipQueryWhenTargetHasData *bool `json:"skipQueryWhenTargetHasData,omitempty"`
 
-	// Identity defines the type of identity used for authentication to the Microsoft Graph API.
-	Identity *Identity `json:"identity,omitempty"`
+	// MaxAge limits SkipQueryWhenTargetHasData to target data fetched less than MaxAge ago,
+	// according to the fetchedAt of its envelope. Requires Envelope
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+
+	// RefreshInterval queries Microsoft Graph at most once per interval, keeping the data in the
+	// targets in between. The time of the last query is stored in LastQueryTimeTarget.
+	// Cannot be combined with context targets, as the context is not kept between reconciles
+	// +optional
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+
+	// LastQueryTimeTarget where to store the time of the last query when RefreshInterval is set.
+	// Can be status.<field> or metadata.annotations.<key>.
+	// Default is metadata.annotations.msgraph.fn.crossplane.io/last-query-time, suffixed with .<name> for named queries
+	// +optional
+	LastQueryTimeTarget *string `json:"lastQueryTimeTarget,omitempty"`
+
+	// DriftDetection reports when the query results differ from the data already in the target
+	// +optional
+	DriftDetection *DriftDetection `json:"driftDetection,omitempty"`
+
+	// Assertions are requirements on the query results, e.g. that users are members of a group.
+	// They only check values the query returns, e.g. not app role assignments of service principals.
+	// Cannot be combined with SkipQueryWhenTargetHasData or RefreshInterval, which skip the query
+	// +optional
+	Assertions []Assertion `json:"assertions,omitempty"`
+
+	// AssertionFailurePolicy controls what happens when an assertion fails. Failed assertions always
+	// set the AssertionsSatisfied condition to false.
+	// Supported values: Condition, NotReady, Fatal. Default is Condition
+	// +optional
+	AssertionFailurePolicy *AssertionFailurePolicy `json:"assertionFailurePolicy,omitempty"`
+
+	// ResourceTemplate renders a desired composed resource for each query result.
+	// Can be combined with Target and Targets
+	// +optional
+	ResourceTemplate *ResourceTemplate `json:"resourceTemplate,omitempty"`
+}
+
+const (
+	// OutputFormatList stores the query results as a list
+	OutputFormatList OutputFormat = "list"
+	// OutputFormatMapByName stores the query results as a map keyed by the name they were queried by.
+	// Display names are not unique, results sharing a name are refused
+	OutputFormatMapByName OutputFormat = "mapByName"
+	// OutputFormatMapByID stores the query results as a map keyed by object ID
+	OutputFormatMapByID OutputFormat = "mapById"
+)
+
+const (
+	// MergeStrategyReplace replaces the data in the target with the query results
+	MergeStrategyReplace MergeStrategy = "replace"
+	// MergeStrategyAppend appends the query results to the list in the target
+	MergeStrategyAppend MergeStrategy = "append"
+	// MergeStrategyUnion appends the query results not yet in the list in the target
+	MergeStrategyUnion MergeStrategy = "union"
+	// MergeStrategyMergeByKey merges the query results into the objects with the same ID in the target
+	MergeStrategyMergeByKey MergeStrategy = "mergeByKey"
+)
+
+// MergeStrategy controls how query results are combined with data already in the target.
+// Supported values: replace;append;union;mergeByKey
+type MergeStrategy string
+
+// DriftDetection configures how differences between the query results and the data already
+// in the first target are reported
+type DriftDetection struct {
+	// Severity of the results reporting drift.
+	// Supported values: Normal, Warning. Default is Normal
+	// +optional
+	Severity *DriftSeverity `json:"severity,omitempty"`
+
+	// Target where to store the diff of added, removed and changed results
+	// +optional
+	Target *string `json:"target,omitempty"`
 }
 
+const (
+	// DriftSeverityNormal reports drift with Normal results
+	DriftSeverityNormal DriftSeverity = "Normal"
+	// DriftSeverityWarning reports drift with Warning results
+	DriftSeverityWarning DriftSeverity = "Warning"
+)
+
+// DriftSeverity is the severity of the results reporting drift.
+// Supported values: Normal;Warning
+type DriftSeverity string
+
+// Assertion is a requirement on the query results: the values selected by Path must contain
+// every value of Contains and ContainsRef. Only membership of values in the results is checked
+type Assertion struct {
+	// Name of the assertion, used in messages
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Path selecting string values from the query results, e.g. [*].userPrincipalName
+	Path string `json:"path"`
+
+	// Contains lists values the selected values must contain
+	// +optional
+	Contains []string `json:"contains,omitempty"`
+
+	// ContainsRef is a reference expression resolving values the selected values must contain
+	// +optional
+	ContainsRef *string `json:"containsRef,omitempty"`
+}
+
+const (
+	// AssertionFailurePolicyCondition only sets the AssertionsSatisfied condition
+	AssertionFailurePolicyCondition AssertionFailurePolicy = "Condition"
+	// AssertionFailurePolicyNotReady also marks the desired XR as not ready
+	AssertionFailurePolicyNotReady AssertionFailurePolicy = "NotReady"
+	// AssertionFailurePolicyFatal also fails the function
+	AssertionFailurePolicyFatal AssertionFailurePolicy = "Fatal"
+)
+
+// AssertionFailurePolicy controls what happens when an assertion fails.
+// Supported values: Condition;NotReady;Fatal
+type AssertionFailurePolicy string
+
+// ResourceTemplate is a composed resource rendered for each query result.
+type ResourceTemplate struct {
+	// NamePrefix of the composed resources. Each resource is named <namePrefix>-<name>, with the
+	// name taken from the NameFromField of its result, so that names do not depend on result order
+	NamePrefix string `json:"namePrefix"`
+
+	// NameFromField is the path of the field within each result the resource name is built from.
+	// Default is id
+	// +optional
+	NameFromField *string `json:"nameFromField,omitempty"`
+
+	// Base is the composed resource rendered for each result
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:EmbeddedResource
+	Base runtime.RawExtension `json:"base"`
+
+	// Patches copy fields of each result to the rendered composed resource
+	// +optional
+	Patches []ResourcePatch `json:"patches,omitempty"`
+}
+
+// ResourcePatch copies a field of a query result to a field of a rendered composed resource.
+type ResourcePatch struct {
+	// FromFieldPath is the path of the field within the result, e.g. id.
+	// The patch is skipped for results without the field
+	FromFieldPath string `json:"fromFieldPath"`
+
+	// ToFieldPath is the path of the field within the composed resource, e.g. spec.forProvider.memberObjectId
+	ToFieldPath string `json:"toFieldPath"`
+}
+
+// ResultTarget is an additional target to store the Query Result in
+type ResultTarget struct {
+	// Target where to store the Query Result
+	Target string `json:"target"`
+
+	// Transform is applied to the query result before it is stored in this target,
+	// replacing the transform of the query
+	// +optional
+	Transform *string `json:"transform,omitempty"`
+}
+
+// OutputFormat controls how query results are stored in the target.
+// Supported values: list;mapByName;mapById
+type OutputFormat string
+
 // Identity defines the type of identity used for authentication to the Microsoft Graph API.
 type Identity struct {
 	// Type of credentials used to authenticate to the Microsoft Graph API.
-	Type IdentityType `json:"type"`
+	// Default is AzureServicePrincipalCredentials
+	// +optional
+	Type IdentityType `json:"type,omitempty"`
+
+	// CredentialsName is the name of the function credentials holding the Azure credentials.
+	// Default is azure-creds
+	// +optional
+	CredentialsName *string `json:"credentialsName,omitempty"`
+
+	// CredentialsKey is the key of the Azure credentials JSON within the function credentials data.
+	// Default is credentials
+	// +optional
+	CredentialsKey *string `json:"credentialsKey,omitempty"`
+
+	// ManagedIdentityClientID is the client ID of a user-assigned managed identity.
+	// Only used with AzureManagedIdentityCredentials, defaults to the system-assigned identity
+	// +optional
+	ManagedIdentityClientID *string `json:"managedIdentityClientId,omitempty"`
+
+	// ManagedIdentityResourceID is the resource ID of a user-assigned managed identity.
+	// Only used with AzureManagedIdentityCredentials, mutually exclusive with ManagedIdentityClientID
+	// +optional
+	ManagedIdentityResourceID *string `json:"managedIdentityResourceId,omitempty"`
 }
 
 const (
@@ -82,8 +405,13 @@ const (
 	IdentityTypeAzureServicePrincipalCredentials IdentityType = "AzureServicePrincipalCredentials"
 	// IdentityTypeAzureWorkloadIdentityCredentials defines default IdentityType which uses workload identity credentials for authentication
 	IdentityTypeAzureWorkloadIdentityCredentials IdentityType = "AzureWorkloadIdentityCredentials"
+	// IdentityTypeAzureManagedIdentityCredentials defines IdentityType which uses the node or pod managed identity for authentication
+	IdentityTypeAzureManagedIdentityCredentials IdentityType = "AzureManagedIdentityCredentials"
+	// IdentityTypeAzureDefaultCredentials defines IdentityType which tries workload identity, managed identity,
+	// environment and client secret credentials in turn
+	IdentityTypeAzureDefaultCredentials IdentityType = "AzureDefaultCredentials"
 )
 
 // IdentityType controls type of credentials to use for authentication to the Microsoft Graph API.
-// Supported values: AzureServicePrincipalCredentials;AzureWorkloadIdentityCredentials
+// Supported values: AzureServicePrincipalCredentials;AzureWorkloadIdentityCredentials;AzureManagedIdentityCredentials;AzureDefaultCredentials
 type IdentityType string
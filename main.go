@@ -27,7 +27,7 @@ func (c *CLI) Run() error {
 
 	return function.Serve(&Function{
 		log:        log,
-		graphQuery: &GraphQuery{},
+		graphQuery: &GraphQuery{log: log},
 	},
 		function.Listen(c.Network, c.Address),
 		function.MTLSCertificates(c.TLSCertsDir),
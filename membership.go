@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// memberMatchFields are the fields of a group member a declared member may match, ignoring case
+var memberMatchFields = []string{"userPrincipalName", "mail", "displayName", "appId", "id"}
+
+// membershipDrift compares the declared members with the actual members of a group. It returns
+// the declared members which are missing from the group, the members which are not declared and
+// the members which are. Members are sorted by object ID, so the result does not depend on the
+// order Microsoft Graph returned them in.
+func membershipDrift(declared []*string, members []interface{}) map[string]interface{} {
+	sorted := append([]interface{}{}, members...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return memberID(sorted[i]) < memberID(sorted[j])
+	})
+
+	found := make(map[string]bool, len(declared))
+	matching := []interface{}{}
+	unexpected := []interface{}{}
+	for _, member := range sorted {
+		matched := false
+		for _, d := range declared {
+			if d != nil && memberMatches(member, *d) {
+				found[strings.ToLower(*d)] = true
+				matched = true
+			}
+		}
+		if matched {
+			matching = append(matching, member)
+		} else {
+			unexpected = append(unexpected, member)
+		}
+	}
+
+	missing := []interface{}{}
+	seen := make(map[string]bool, len(declared))
+	for _, d := range declared {
+		if d == nil || *d == "" {
+			continue
+		}
+		key := strings.ToLower(*d)
+		if found[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		missing = append(missing, *d)
+	}
+
+	return map[string]interface{}{
+		"missing":    missing,
+		"unexpected": unexpected,
+		"matching":   matching,
+	}
+}
+
+// memberID returns the object ID of a group member
+func memberID(member interface{}) string {
+	if obj, ok := member.(map[string]interface{}); ok {
+		if id, ok := obj["id"].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// memberMatches reports whether a group member is the declared member
+func memberMatches(member interface{}, declared string) bool {
+	obj, ok := member.(map[string]interface{})
+	if !ok || declared == "" {
+		return false
+	}
+	for _, field := range memberMatchFields {
+		if v, ok := obj[field].(string); ok && strings.EqualFold(v, declared) {
+			return true
+		}
+	}
+	return false
+}
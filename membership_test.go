@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestMembershipDrift(t *testing.T) {
+	var (
+		alice = map[string]interface{}{"id": "alice-id", "displayName": "Alice", "userPrincipalName": "alice@example.com", "type": "user"}
+		bob   = map[string]interface{}{"id": "bob-id", "displayName": "Bob", "userPrincipalName": "bob@example.com", "type": "user"}
+		app   = map[string]interface{}{"id": "app-id", "displayName": "Deployer", "appId": "deployer-app-id", "type": "servicePrincipal"}
+	)
+
+	type args struct {
+		declared []*string
+		members  []interface{}
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   map[string]interface{}
+	}{
+		"NoDrift": {
+			reason: "Declared members matching every member, ignoring case, should be reported as matching",
+			args: args{
+				declared: []*string{ptr.To("Alice@Example.com"), ptr.To("bob@example.com")},
+				members:  []interface{}{bob, alice},
+			},
+			want: map[string]interface{}{
+				"missing":    []interface{}{},
+				"unexpected": []interface{}{},
+				"matching":   []interface{}{alice, bob},
+			},
+		},
+		"Drift": {
+			reason: "Declared members not in the group should be missing and undeclared members unexpected",
+			args: args{
+				declared: []*string{ptr.To("alice@example.com"), ptr.To("carol@example.com"), ptr.To("deployer-app-id")},
+				members:  []interface{}{alice, bob, app},
+			},
+			want: map[string]interface{}{
+				"missing":    []interface{}{"carol@example.com"},
+				"unexpected": []interface{}{bob},
+				"matching":   []interface{}{alice, app},
+			},
+		},
+		"MatchByIDAndDisplayName": {
+			reason: "Declared members should match the object ID or display name of members",
+			args: args{
+				declared: []*string{ptr.To("bob-id"), ptr.To("Deployer")},
+				members:  []interface{}{alice, bob, app},
+			},
+			want: map[string]interface{}{
+				"missing":    []interface{}{},
+				"unexpected": []interface{}{alice},
+				"matching":   []interface{}{app, bob},
+			},
+		},
+		"DuplicateMissing": {
+			reason: "A missing member declared twice should be reported once",
+			args: args{
+				declared: []*string{ptr.To("carol@example.com"), nil, ptr.To("CAROL@example.com")},
+				members:  []interface{}{},
+			},
+			want: map[string]interface{}{
+				"missing":    []interface{}{"carol@example.com"},
+				"unexpected": []interface{}{},
+				"matching":   []interface{}{},
+			},
+		},
+		"NothingDeclared": {
+			reason: "Every member should be unexpected when no members are declared",
+			args: args{
+				members: []interface{}{alice},
+			},
+			want: map[string]interface{}{
+				"missing":    []interface{}{},
+				"unexpected": []interface{}{alice},
+				"matching":   []interface{}{},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := membershipDrift(tc.args.declared, tc.args.members)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nmembershipDrift(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestGroupMembershipDrift(t *testing.T) {
+	var (
+		xr = `{
+			"apiVersion": "example.org/v1",
+			"kind": "XR",
+			"metadata": {"name": "cool-xr"},
+			"spec": {"team": {"group": "platform-admins", "members": ["alice@example.com", "carol@example.com"]}}
+		}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"MembersRefFromSpec": {
+			reason: "The Function should resolve groupRef and membersRef and store the drift report",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembershipDrift",
+						"groupRef": "spec.team.group",
+						"membersRef": "spec.team.members",
+						"target": "status.membershipDrift"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupMembershipDrift"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"team": {"group": "platform-admins", "members": ["alice@example.com", "carol@example.com"]}},
+								"status": {
+									"membershipDrift": {
+										"missing": ["carol@example.com"],
+										"unexpected": [
+											{"id": "bob-id", "userPrincipalName": "bob@example.com"}
+										],
+										"matching": [
+											{"id": "alice-id", "userPrincipalName": "alice@example.com"}
+										]
+									}
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"MembersRefNotFound": {
+			reason: "The Function should fail when membersRef cannot be resolved",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembershipDrift",
+						"group": "platform-admins",
+						"membersRef": "context.team.members",
+						"target": "status.membershipDrift"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "cannot resolve membersRef: context.team.members not found",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
+					if in.QueryType != "GroupMembershipDrift" {
+						return nil, errors.Errorf("unsupported query type: %s", in.QueryType)
+					}
+					if in.Group == nil || *in.Group != "platform-admins" {
+						return nil, errors.New("group not found")
+					}
+					return membershipDrift(in.Members, []interface{}{
+						map[string]interface{}{"id": "bob-id", "userPrincipalName": "bob@example.com"},
+						map[string]interface{}{"id": "alice-id", "userPrincipalName": "alice@example.com"},
+					}), nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+)
+
+// getMergeStrategy returns the configured merge strategy, defaulting to replace
+func getMergeStrategy(in *v1beta1.Input) v1beta1.MergeStrategy {
+	if in.MergeStrategy == nil || *in.MergeStrategy == "" {
+		return v1beta1.MergeStrategyReplace
+	}
+	return *in.MergeStrategy
+}
+
+// validateMergeStrategy checks that the merge strategy is supported and only used with
+// status and context targets
+func validateMergeStrategy(in *v1beta1.Input) error {
+	strategy := getMergeStrategy(in)
+	switch strategy {
+	case v1beta1.MergeStrategyReplace:
+		return nil
+	case v1beta1.MergeStrategyAppend, v1beta1.MergeStrategyUnion, v1beta1.MergeStrategyMergeByKey:
+	default:
+		return errors.Errorf("unsupported mergeStrategy: %s", strategy)
+	}
+
+	for _, t := range resultTargets(in) {
+		if !strings.HasPrefix(t.Target, "status.") && !strings.HasPrefix(t.Target, "context.") {
+			return errors.Errorf("mergeStrategy %s is only supported for status and context targets, got %s", strategy, t.Target)
+		}
+	}
+	return nil
+}
+
+// mergeResults combines the query results with the data already stored in the target,
+// according to the merge strategy of the input
+func mergeResults(in *v1beta1.Input, existing, results interface{}) (interface{}, error) {
+	strategy := getMergeStrategy(in)
+	if strategy == v1beta1.MergeStrategyReplace || existing == nil {
+		return results, nil
+	}
+	merged, err := mergeValues(strategy, existing, results)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot apply mergeStrategy %s", strategy)
+	}
+	return merged, nil
+}
+
+// compositeStatus returns the status of the composite resource of a state
+func compositeStatus(state *fnv1.State) map[string]interface{} {
+	status, _ := state.GetComposite().GetResource().AsMap()["status"].(map[string]interface{})
+	return status
+}
+
+// pipelineStatusValue returns the value of a status field written earlier in this pipeline run,
+// by earlier function steps or by earlier queries and targets of this step. Results are never
+// merged into the observed status, which propagateDesiredXR carries into the desired XR: it holds
+// the output of the previous reconcile, so merging into it would grow the target on every reconcile.
+func pipelineStatusValue(req *fnv1.RunFunctionRequest, desiredStatus map[string]interface{}, field string) interface{} {
+	desired, ok := nestedValue(desiredStatus, field)
+	if !ok {
+		return nil
+	}
+	if _, ok := nestedValue(compositeStatus(req.GetDesired()), field); ok {
+		return desired
+	}
+	if observed, ok := nestedValue(compositeStatus(req.GetObserved()), field); ok && reflect.DeepEqual(observed, desired) {
+		return nil
+	}
+	return desired
+}
+
+// mergeValues merges lists according to the strategy and objects key by key, so that
+// results keyed by tenant, name or ID are merged per key. Other values are replaced.
+func mergeValues(strategy v1beta1.MergeStrategy, existing, results interface{}) (interface{}, error) {
+	existingList, existingIsList := existing.([]interface{})
+	resultsList, resultsIsList := results.([]interface{})
+	if existingIsList || resultsIsList {
+		if !existingIsList || !resultsIsList {
+			return nil, errors.Errorf("cannot merge %s into %s", describeValue(results), describeValue(existing))
+		}
+		return mergeLists(strategy, existingList, resultsList), nil
+	}
+
+	existingMap, existingIsMap := existing.(map[string]interface{})
+	resultsMap, resultsIsMap := results.(map[string]interface{})
+	if !existingIsMap || !resultsIsMap {
+		return results, nil
+	}
+
+	merged := make(map[string]interface{}, len(existingMap)+len(resultsMap))
+	for k, v := range existingMap {
+		merged[k] = v
+	}
+	for k, v := range resultsMap {
+		current, ok := merged[k]
+		if !ok || current == nil {
+			merged[k] = v
+			continue
+		}
+		value, err := mergeValues(strategy, current, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %s", k)
+		}
+		merged[k] = value
+	}
+	return merged, nil
+}
+
+// mergeLists merges the results into the existing list. Append keeps duplicates, union
+// skips results already in the list and mergeByKey merges the fields of results into the
+// existing objects with the same ID.
+func mergeLists(strategy v1beta1.MergeStrategy, existing, results []interface{}) []interface{} {
+	merged := make([]interface{}, 0, len(existing)+len(results))
+	merged = append(merged, existing...)
+	if strategy == v1beta1.MergeStrategyAppend {
+		return append(merged, results...)
+	}
+
+	positions := make(map[string]int, len(merged))
+	for i, element := range merged {
+		if _, seen := positions[mergeKey(element)]; !seen {
+			positions[mergeKey(element)] = i
+		}
+	}
+
+	for _, element := range results {
+		key := mergeKey(element)
+		i, seen := positions[key]
+		if !seen {
+			positions[key] = len(merged)
+			merged = append(merged, element)
+			continue
+		}
+		if strategy == v1beta1.MergeStrategyMergeByKey {
+			merged[i] = mergeObjects(merged[i], element)
+		}
+	}
+	return merged
+}
+
+// mergeObjects returns the fields of the existing object overridden by the fields of the result
+func mergeObjects(existing, result interface{}) interface{} {
+	existingObj, ok := existing.(map[string]interface{})
+	if !ok {
+		return result
+	}
+	resultObj, ok := result.(map[string]interface{})
+	if !ok {
+		return result
+	}
+
+	merged := make(map[string]interface{}, len(existingObj)+len(resultObj))
+	for k, v := range existingObj {
+		merged[k] = v
+	}
+	for k, v := range resultObj {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeKey identifies a list element: objects by their object ID, other values by their JSON encoding
+func mergeKey(element interface{}) string {
+	if obj, ok := element.(map[string]interface{}); ok {
+		if id, ok := obj["id"].(string); ok {
+			return "id:" + id
+		}
+	}
+	encoded, err := json.Marshal(element)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
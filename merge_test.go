@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestMergeResults(t *testing.T) {
+	type args struct {
+		strategy v1beta1.MergeStrategy
+		existing interface{}
+		results  interface{}
+	}
+	type want struct {
+		results interface{}
+		err     error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Replace": {
+			reason: "Replace should store the results as is",
+			args: args{
+				strategy: v1beta1.MergeStrategyReplace,
+				existing: []interface{}{"id-1"},
+				results:  []interface{}{"id-2"},
+			},
+			want: want{results: []interface{}{"id-2"}},
+		},
+		"NoExistingData": {
+			reason: "Results should be stored as is when the target has no data",
+			args: args{
+				strategy: v1beta1.MergeStrategyUnion,
+				results:  []interface{}{"id-2"},
+			},
+			want: want{results: []interface{}{"id-2"}},
+		},
+		"Append": {
+			reason: "Append should keep duplicates",
+			args: args{
+				strategy: v1beta1.MergeStrategyAppend,
+				existing: []interface{}{"id-1", "id-2"},
+				results:  []interface{}{"id-2", "id-3"},
+			},
+			want: want{results: []interface{}{"id-1", "id-2", "id-2", "id-3"}},
+		},
+		"Union": {
+			reason: "Union should skip results already in the target, comparing objects by ID",
+			args: args{
+				strategy: v1beta1.MergeStrategyUnion,
+				existing: []interface{}{
+					map[string]interface{}{"id": "id-1", "displayName": "Developers"},
+				},
+				results: []interface{}{
+					map[string]interface{}{"id": "id-1", "displayName": "Renamed"},
+					map[string]interface{}{"id": "id-2", "displayName": "Operations"},
+				},
+			},
+			want: want{results: []interface{}{
+				map[string]interface{}{"id": "id-1", "displayName": "Developers"},
+				map[string]interface{}{"id": "id-2", "displayName": "Operations"},
+			}},
+		},
+		"MergeByKey": {
+			reason: "MergeByKey should merge the fields of results into the objects with the same ID",
+			args: args{
+				strategy: v1beta1.MergeStrategyMergeByKey,
+				existing: []interface{}{
+					map[string]interface{}{"id": "id-1", "displayName": "Developers", "mail": "dev@example.com"},
+				},
+				results: []interface{}{
+					map[string]interface{}{"id": "id-1", "displayName": "Renamed"},
+					map[string]interface{}{"id": "id-2", "displayName": "Operations"},
+				},
+			},
+			want: want{results: []interface{}{
+				map[string]interface{}{"id": "id-1", "displayName": "Renamed", "mail": "dev@example.com"},
+				map[string]interface{}{"id": "id-2", "displayName": "Operations"},
+			}},
+		},
+		"MergeMaps": {
+			reason: "Results keyed by tenant should be merged per key",
+			args: args{
+				strategy: v1beta1.MergeStrategyUnion,
+				existing: map[string]interface{}{
+					"contoso":  []interface{}{"id-1"},
+					"fabrikam": []interface{}{"id-2"},
+				},
+				results: map[string]interface{}{
+					"contoso":  []interface{}{"id-1", "id-3"},
+					"tailspin": []interface{}{"id-4"},
+				},
+			},
+			want: want{results: map[string]interface{}{
+				"contoso":  []interface{}{"id-1", "id-3"},
+				"fabrikam": []interface{}{"id-2"},
+				"tailspin": []interface{}{"id-4"},
+			}},
+		},
+		"Mismatch": {
+			reason: "A list cannot be merged into data which is not a list",
+			args: args{
+				strategy: v1beta1.MergeStrategyAppend,
+				existing: "id-1",
+				results:  []interface{}{"id-2"},
+			},
+			want: want{err: errors.Wrap(errors.New("cannot merge a list into a string"), "cannot apply mergeStrategy append")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := &v1beta1.Input{Query: v1beta1.Query{MergeStrategy: &tc.args.strategy}}
+			got, err := mergeResults(in, tc.args.existing, tc.args.results)
+
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nmergeResults(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.results, got); diff != "" {
+				t.Errorf("%s\nmergeResults(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestMergeStrategy(t *testing.T) {
+	var (
+		xr    = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"UnionIntoStatus": {
+			reason: "The Function should add results not yet in the status written by earlier steps, ignoring the observed status",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers", "Operations"],
+						"target": "status.principals",
+						"mergeStrategy": "union"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"status": {
+									"principals": [
+										{"id": "user-id", "userPrincipalName": "user@example.com"},
+										{"id": "removed-id", "displayName": "Removed"}
+									]
+								}
+							}`),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"status": {
+									"principals": [
+										{"id": "user-id", "userPrincipalName": "user@example.com"},
+										{"id": "Developers-id", "displayName": "Developers"}
+									]
+								}
+							}`),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"status": {
+									"principals": [
+										{"id": "user-id", "userPrincipalName": "user@example.com"},
+										{"id": "Developers-id", "displayName": "Developers"},
+										{"id": "Operations-id", "displayName": "Operations"}
+									]
+								}
+							}`),
+						},
+					},
+				},
+			},
+		},
+		"MergeByKeyIntoContext": {
+			reason: "The Function should merge results into the objects with the same ID in the context",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "context.principals",
+						"mergeStrategy": "mergeByKey"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"principals": [
+							{"id": "Developers-id", "owner": "team-a"}
+						]
+					}`),
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"principals": [
+							{"id": "Developers-id", "displayName": "Developers", "owner": "team-a"}
+						]
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"UnsupportedTarget": {
+			reason: "The Function should refuse a merge strategy for targets other than status and context",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "metadata.annotations.groups",
+						"mergeStrategy": "union"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "mergeStrategy union is only supported for status and context targets, got metadata.annotations.groups",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"UnsupportedStrategy": {
+			reason: "The Function should refuse an unsupported merge strategy",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "status.groups",
+						"mergeStrategy": "prepend"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "unsupported mergeStrategy: prepend",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
+					results := make([]interface{}, 0, len(in.Groups))
+					for _, group := range in.Groups {
+						results = append(results, map[string]interface{}{
+							"id":          *group + "-id",
+							"displayName": *group,
+						})
+					}
+					return results, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestMergeStrategyReconcile(t *testing.T) {
+	var (
+		xr    = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		strategy v1beta1.MergeStrategy
+		first    []string
+		second   []string
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   string
+	}{
+		"Append": {
+			reason: "Append should not grow the target with the output of the previous reconcile",
+			args: args{
+				strategy: v1beta1.MergeStrategyAppend,
+				first:    []string{"Developers"},
+				second:   []string{"Developers"},
+			},
+			want: `{"principals": [{"id": "Developers-id", "displayName": "Developers"}]}`,
+		},
+		"Union": {
+			reason: "Union should drop principals no longer returned by the query",
+			args: args{
+				strategy: v1beta1.MergeStrategyUnion,
+				first:    []string{"Developers", "Operations"},
+				second:   []string{"Developers"},
+			},
+			want: `{"principals": [{"id": "Developers-id", "displayName": "Developers"}]}`,
+		},
+		"MergeByKey": {
+			reason: "MergeByKey should drop principals no longer returned by the query",
+			args: args{
+				strategy: v1beta1.MergeStrategyMergeByKey,
+				first:    []string{"Developers", "Operations"},
+				second:   []string{"Operations"},
+			},
+			want: `{"principals": [{"id": "Operations-id", "displayName": "Operations"}]}`,
+		},
+	}
+
+	run := func(t *testing.T, strategy v1beta1.MergeStrategy, groups []string, observed *structpb.Struct) *fnv1.RunFunctionResponse {
+		t.Helper()
+		f := &Function{
+			graphQuery: &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, _ *v1beta1.Input) (interface{}, error) {
+					results := make([]interface{}, 0, len(groups))
+					for _, group := range groups {
+						results = append(results, map[string]interface{}{"id": group + "-id", "displayName": group})
+					}
+					return results, nil
+				},
+			},
+			log: logging.NewNopLogger(),
+		}
+		rsp, err := f.RunFunction(context.Background(), &fnv1.RunFunctionRequest{
+			Meta: &fnv1.RequestMeta{Tag: "hello"},
+			Input: resource.MustStructJSON(`{
+				"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+				"kind": "Input",
+				"queryType": "GroupObjectIDs",
+				"groups": ["ignored"],
+				"target": "status.principals",
+				"mergeStrategy": "` + string(strategy) + `"
+			}`),
+			Observed: &fnv1.State{Composite: &fnv1.Resource{Resource: observed}},
+			Credentials: map[string]*fnv1.Credentials{
+				"azure-creds": {
+					Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("f.RunFunction(...): %v", err)
+		}
+		return rsp
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			first := run(t, tc.args.strategy, tc.args.first, resource.MustStructJSON(xr))
+
+			// Feed the output of the first reconcile back in as the observed XR
+			second := run(t, tc.args.strategy, tc.args.second, first.GetDesired().GetComposite().GetResource())
+
+			want := resource.MustStructJSON(tc.want).AsMap()
+			if diff := cmp.Diff(want, compositeStatus(second.GetDesired())); diff != "" {
+				t.Errorf("%s\nsecond reconcile: -want status, +got status:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/request"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+const (
+	annotationsTargetPrefix = "metadata.annotations."
+	labelsTargetPrefix      = "metadata.labels."
+)
+
+// parseMetadataTarget parses a metadata.annotations.<key> or metadata.labels.<key> target
+// into whether it targets a label and the annotation or label key
+func parseMetadataTarget(target string) (bool, string, error) {
+	var (
+		label bool
+		key   string
+	)
+	switch {
+	case strings.HasPrefix(target, annotationsTargetPrefix):
+		key = strings.TrimPrefix(target, annotationsTargetPrefix)
+	case strings.HasPrefix(target, labelsTargetPrefix):
+		label, key = true, strings.TrimPrefix(target, labelsTargetPrefix)
+	default:
+		return false, "", errors.Errorf("invalid target %s: expected metadata.annotations.<key> or metadata.labels.<key>", target)
+	}
+
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return false, "", errors.Errorf("invalid target %s: invalid key %s: %s", target, key, strings.Join(errs, "; "))
+	}
+	return label, key, nil
+}
+
+// metadataValue serializes query results to an annotation or label value. Strings are
+// used as is, lists of scalars are comma-joined and other results are serialized to JSON.
+func metadataValue(results interface{}) (string, error) {
+	switch v := results.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, element := range v {
+			s, ok := scalarString(element)
+			if !ok {
+				return marshalMetadataValue(results)
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ","), nil
+	}
+
+	if s, ok := scalarString(results); ok {
+		return s, nil
+	}
+	return marshalMetadataValue(results)
+}
+
+// scalarString returns the string form of a string, number or boolean
+func scalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool, float64, int, int64:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// marshalMetadataValue serializes query results to JSON
+func marshalMetadataValue(results interface{}) (string, error) {
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot serialize results to JSON")
+	}
+	return string(encoded), nil
+}
+
+// putQueryResultToMetadata sets an annotation or label of the desired XR to the query results
+func (f *Function) putQueryResultToMetadata(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input, results interface{}) error {
+	label, key, err := parseMetadataTarget(in.Target)
+	if err != nil {
+		return err
+	}
+
+	value, err := metadataValue(results)
+	if err != nil {
+		return err
+	}
+
+	_, dxr, err := f.getDesiredXRAndStatus(req, rsp)
+	if err != nil {
+		return err
+	}
+
+	if label {
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return errors.Errorf("cannot set label %s to %q: %s", key, value, strings.Join(errs, "; "))
+		}
+		labels := dxr.Resource.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[key] = value
+		dxr.Resource.SetLabels(labels)
+	} else {
+		annotations := dxr.Resource.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = value
+		dxr.Resource.SetAnnotations(annotations)
+	}
+
+	f.log.Debug("Updating desired composite resource metadata", "target", in.Target, "value", value)
+
+	// Save the updated desired composite resource
+	if err := response.SetDesiredCompositeResource(rsp, dxr); err != nil {
+		return errors.Wrapf(err, "cannot set desired composite resource in %T", rsp)
+	}
+	return nil
+}
+
+// observedMetadataTargetData returns the value of a metadata target in the observed XR
+func observedMetadataTargetData(req *fnv1.RunFunctionRequest, target string) (string, error) {
+	label, key, err := parseMetadataTarget(target)
+	if err != nil {
+		return "", err
+	}
+	oxr, err := request.GetObservedCompositeResource(req)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get observed composite resource")
+	}
+	if label {
+		return oxr.Resource.GetLabels()[key], nil
+	}
+	return oxr.Resource.GetAnnotations()[key], nil
+}
+
+// checkMetadataTargetHasData checks if the metadata target has data in the observed XR.
+func checkMetadataTargetHasData(req *fnv1.RunFunctionRequest, target string) bool {
+	value, err := observedMetadataTargetData(req, target)
+	return err == nil && value != ""
+}
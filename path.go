@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// pathSegmentKind is the kind of a segment of a result path
+type pathSegmentKind int
+
+const (
+	// pathField selects a field of an object, e.g. .id or [apiextensions.crossplane.io/environment]
+	pathField pathSegmentKind = iota
+	// pathIndex selects an element of a list, e.g. [0]
+	pathIndex
+	// pathWildcard selects every element of a list, e.g. [*]
+	pathWildcard
+	// pathFilter selects the elements of a list matching a comparison, e.g. [?type==servicePrincipal]
+	pathFilter
+)
+
+// pathSegment is a single segment of a result path
+type pathSegment struct {
+	kind  pathSegmentKind
+	field string
+	index int
+
+	// Filter comparison, e.g. [?type!=user]
+	filterPath  []pathSegment
+	filterValue string
+	filterNot   bool
+}
+
+// parsePath parses a result path such as members[*].id or members[?type==user].displayName.
+// It supports the dot and bracket notation of ParseNestedKey, list indexes, [*] wildcards
+// and [?field==value] or [?field!=value] filters.
+func parsePath(path string) ([]pathSegment, error) {
+	var segments []pathSegment
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+		case '[':
+			end := closingBracket(path, i)
+			if end < 0 {
+				return nil, errors.Errorf("invalid path %s: unterminated [", path)
+			}
+			segment, err := parseBracketSegment(path[i+1 : end])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid path %s", path)
+			}
+			segments = append(segments, segment)
+			i = end + 1
+		case ']':
+			return nil, errors.Errorf("invalid path %s: unexpected ]", path)
+		default:
+			end := i
+			for end < len(path) && path[end] != '.' && path[end] != '[' && path[end] != ']' {
+				end++
+			}
+			segments = append(segments, pathSegment{kind: pathField, field: path[i:end]})
+			i = end
+		}
+	}
+
+	if len(segments) == 0 {
+		return nil, errors.Errorf("invalid path %q", path)
+	}
+	return segments, nil
+}
+
+// closingBracket returns the position of the bracket closing the one at start, ignoring
+// brackets in quoted filter values
+func closingBracket(path string, start int) int {
+	var quote byte
+	depth := 0
+	for i := start; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// parseBracketSegment parses the content of a bracket segment
+func parseBracketSegment(content string) (pathSegment, error) {
+	switch {
+	case content == "":
+		return pathSegment{}, errors.New("empty []")
+	case content == "*":
+		return pathSegment{kind: pathWildcard}, nil
+	case strings.HasPrefix(content, "?"):
+		return parseFilter(strings.TrimPrefix(content, "?"))
+	}
+
+	if index, err := strconv.Atoi(content); err == nil {
+		if index < 0 {
+			return pathSegment{}, errors.Errorf("negative index [%d]", index)
+		}
+		return pathSegment{kind: pathIndex, index: index}, nil
+	}
+	return pathSegment{kind: pathField, field: content}, nil
+}
+
+// parseFilter parses a filter such as type==user, (type=='user') or type!=user
+func parseFilter(filter string) (pathSegment, error) {
+	filter = strings.TrimSpace(filter)
+	if strings.HasPrefix(filter, "(") && strings.HasSuffix(filter, ")") {
+		filter = strings.TrimSpace(filter[1 : len(filter)-1])
+	}
+
+	operator, not := "==", false
+	if strings.Contains(filter, "!=") {
+		operator, not = "!=", true
+	}
+	field, value, found := strings.Cut(filter, operator)
+	if !found {
+		return pathSegment{}, errors.Errorf("invalid filter [?%s]: expected == or !=", filter)
+	}
+
+	field = strings.TrimPrefix(strings.TrimSpace(field), "@.")
+	filterPath, err := parsePath(field)
+	if err != nil {
+		return pathSegment{}, errors.Wrapf(err, "invalid filter [?%s]", filter)
+	}
+
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+
+	return pathSegment{kind: pathFilter, filterPath: filterPath, filterValue: value, filterNot: not}, nil
+}
+
+// evaluatePath evaluates a result path against data. Paths using [*] or filters
+// return a list of every matching value, other paths return the single value found.
+func evaluatePath(data interface{}, path string) (interface{}, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateSegments(data, segments)
+}
+
+// evaluateSegments evaluates parsed path segments against data
+func evaluateSegments(data interface{}, segments []pathSegment) (interface{}, error) {
+	current := data
+	for i, segment := range segments {
+		switch segment.kind {
+		case pathField:
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("cannot get field %s of %s", segment.field, describeValue(current))
+			}
+			value, exists := obj[segment.field]
+			if !exists {
+				return nil, errors.Errorf("field %s not found", segment.field)
+			}
+			current = value
+		case pathIndex:
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil, errors.Errorf("cannot get index [%d] of %s", segment.index, describeValue(current))
+			}
+			if segment.index >= len(list) {
+				return nil, errors.Errorf("index [%d] out of range for list of length %d", segment.index, len(list))
+			}
+			current = list[segment.index]
+		case pathWildcard, pathFilter:
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil, errors.Errorf("cannot select elements of %s", describeValue(current))
+			}
+			projected, err := projectList(list, segment, segments[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			return projected, nil
+		}
+	}
+	return current, nil
+}
+
+// selectsMissingField reports whether a field selected by path segments, before any wildcard
+// or filter, does not exist
+func selectsMissingField(data interface{}, segments []pathSegment) bool {
+	current := data
+	for _, segment := range segments {
+		switch segment.kind {
+		case pathField:
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			value, exists := obj[segment.field]
+			if !exists {
+				return true
+			}
+			current = value
+		case pathIndex:
+			list, ok := current.([]interface{})
+			if !ok || segment.index >= len(list) {
+				return false
+			}
+			current = list[segment.index]
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// projectList evaluates the remaining path segments against every element of a list
+// selected by a wildcard or filter. An element the remaining path does not match fails the
+// projection, so the result keeps one value per selected element, and lists selected by
+// nested wildcards or filters are flattened.
+func projectList(list []interface{}, selector pathSegment, rest []pathSegment) ([]interface{}, error) {
+	projected := make([]interface{}, 0, len(list))
+	for i, element := range list {
+		if selector.kind == pathFilter && !matchesFilter(element, selector) {
+			continue
+		}
+
+		value, err := evaluateSegments(element, rest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "element %d", i)
+		}
+		if nested, ok := value.([]interface{}); ok && projects(rest) {
+			projected = append(projected, nested...)
+			continue
+		}
+		projected = append(projected, value)
+	}
+	return projected, nil
+}
+
+// projects reports whether path segments contain a wildcard or filter
+func projects(segments []pathSegment) bool {
+	for _, segment := range segments {
+		if segment.kind == pathWildcard || segment.kind == pathFilter {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFilter reports whether an element matches a filter segment
+func matchesFilter(element interface{}, filter pathSegment) bool {
+	value, err := evaluateSegments(element, filter.filterPath)
+	matches := err == nil && fmt.Sprint(value) == filter.filterValue
+	return matches != filter.filterNot
+}
+
+// describeValue describes the type of a value for error messages
+func describeValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case float64, int, int64:
+		return "a number"
+	}
+	return fmt.Sprintf("a %T", value)
+}
+
+// pathStrings converts the value of a path to a list of strings. A single string is
+// returned as a list of one element. Every element must be a string.
+func pathStrings(value interface{}) ([]*string, error) {
+	switch v := value.(type) {
+	case string:
+		return []*string{&v}, nil
+	case []interface{}:
+		result := make([]*string, 0, len(v))
+		for i, element := range v {
+			s, ok := element.(string)
+			if !ok {
+				return nil, errors.Errorf("element %d is %s, not a string", i, describeValue(element))
+			}
+			result = append(result, &s)
+		}
+		return result, nil
+	case []string:
+		result := make([]*string, 0, len(v))
+		for i := range v {
+			result = append(result, &v[i])
+		}
+		return result, nil
+	}
+	return nil, errors.Errorf("value is %s, not a string or list of strings", describeValue(value))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+)
+
+func TestEvaluatePath(t *testing.T) {
+	data := map[string]interface{}{
+		"members": []interface{}{
+			map[string]interface{}{"id": "user-id", "type": "user", "displayName": "User"},
+			map[string]interface{}{"id": "sp-id", "type": "servicePrincipal", "displayName": "App"},
+			map[string]interface{}{"type": "unknown"},
+		},
+		"groups": []interface{}{
+			map[string]interface{}{"owners": []interface{}{"owner-1", "owner-2"}},
+			map[string]interface{}{"owners": []interface{}{"owner-3"}},
+		},
+		"apiextensions.crossplane.io/environment": map[string]interface{}{"region": "westeurope"},
+	}
+
+	type want struct {
+		value interface{}
+		err   error
+	}
+
+	cases := map[string]struct {
+		reason string
+		path   string
+		want   want
+	}{
+		"Field": {
+			reason: "A field path should return the value of the field",
+			path:   "members[0].id",
+			want:   want{value: "user-id"},
+		},
+		"BracketField": {
+			reason: "Bracket notation should select fields containing dots",
+			path:   "[apiextensions.crossplane.io/environment].region",
+			want:   want{value: "westeurope"},
+		},
+		"Wildcard": {
+			reason: "A wildcard should return the value of the field of every element",
+			path:   "members[*].type",
+			want:   want{value: []interface{}{"user", "servicePrincipal", "unknown"}},
+		},
+		"WildcardMissingField": {
+			reason: "A wildcard should return an error naming the first element without the field",
+			path:   "members[*].id",
+			want:   want{err: errors.Wrap(errors.New("field id not found"), "element 2")},
+		},
+		"Filter": {
+			reason: "A filter should only select matching elements",
+			path:   "members[?type==servicePrincipal].displayName",
+			want:   want{value: []interface{}{"App"}},
+		},
+		"QuotedNegatedFilter": {
+			reason: "A negated filter with a quoted value should select elements not matching it",
+			path:   "members[?(@.type!='user')].type",
+			want:   want{value: []interface{}{"servicePrincipal", "unknown"}},
+		},
+		"NestedWildcards": {
+			reason: "Nested wildcards should return a flat list",
+			path:   "groups[*].owners[*]",
+			want:   want{value: []interface{}{"owner-1", "owner-2", "owner-3"}},
+		},
+		"FilterMissingField": {
+			reason: "A filter should return an error naming the first matching element without the field",
+			path:   "members[?type!=user].displayName",
+			want:   want{err: errors.Wrap(errors.New("field displayName not found"), "element 2")},
+		},
+		"MissingField": {
+			reason: "A missing field should return an error",
+			path:   "owners",
+			want:   want{err: errors.New("field owners not found")},
+		},
+		"IndexOutOfRange": {
+			reason: "An index beyond the end of a list should return an error",
+			path:   "members[5]",
+			want:   want{err: errors.New("index [5] out of range for list of length 3")},
+		},
+		"WildcardOnObject": {
+			reason: "A wildcard on an object should return an error",
+			path:   "members[0][*]",
+			want:   want{err: errors.New("cannot select elements of an object")},
+		},
+		"Unterminated": {
+			reason: "An unterminated bracket should return an error",
+			path:   "members[*",
+			want:   want{err: errors.New("invalid path members[*: unterminated [")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			value, err := evaluatePath(data, tc.path)
+
+			if diff := cmp.Diff(tc.want.value, value); diff != "" {
+				t.Errorf("%s\nevaluatePath(...): -want value, +got value:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nevaluatePath(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestPathStrings(t *testing.T) {
+	type want struct {
+		values []*string
+		err    error
+	}
+
+	cases := map[string]struct {
+		reason string
+		value  interface{}
+		want   want
+	}{
+		"String": {
+			reason: "A single string should be returned as a list of one element",
+			value:  "Developers",
+			want:   want{values: []*string{ptr.To("Developers")}},
+		},
+		"ListOfStrings": {
+			reason: "A list of strings should be returned as is",
+			value:  []interface{}{"a", "b"},
+			want:   want{values: []*string{ptr.To("a"), ptr.To("b")}},
+		},
+		"NonStringElement": {
+			reason: "A list with a non-string element should return an error naming the element",
+			value:  []interface{}{"a", map[string]interface{}{"id": "b"}},
+			want:   want{err: errors.New("element 1 is an object, not a string")},
+		},
+		"Number": {
+			reason: "A number should return an error",
+			value:  float64(1),
+			want:   want{err: errors.New("value is a number, not a string or list of strings")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			values, err := pathStrings(tc.value)
+
+			if diff := cmp.Diff(tc.want.values, values); diff != "" {
+				t.Errorf("%s\npathStrings(...): -want values, +got values:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\npathStrings(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
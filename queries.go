@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// queryRun tracks a query of Input.Queries through preparation, execution and result processing.
+// Each query reports to its own response, which is merged into the function response in order.
+type queryRun struct {
+	name    string
+	in      *v1beta1.Input
+	rsp     *fnv1.RunFunctionResponse
+	ready   bool
+	done    bool
+	results interface{}
+
+	// dependency is the query whose results the query uses, if any
+	dependency *queryRun
+}
+
+// validateQueries checks that queries are not combined with a top-level query, that query
+// names are unique and that queries only depend on other named queries without cycles
+func validateQueries(in *v1beta1.Input) error {
+	if in.QueryType != "" || in.Target != "" || len(in.Targets) > 0 || in.ResourceTemplate != nil {
+		return errors.New("queryType and target must be set per query when queries are used")
+	}
+
+	seen := make(map[string]bool, len(in.Queries))
+	named := make(map[string]v1beta1.Query, len(in.Queries))
+	for i, q := range in.Queries {
+		if q.Name == "" {
+			continue
+		}
+		if seen[q.Name] {
+			return errors.Errorf("queries[%d]: duplicate query name %s", i, q.Name)
+		}
+		seen[q.Name] = true
+		named[q.Name] = q
+	}
+
+	dependencies := make(map[string]string, len(in.Queries))
+	for i, q := range in.Queries {
+		if q.FromQuery == nil {
+			continue
+		}
+		dependency, err := fromQueryName(*q.FromQuery)
+		if err != nil {
+			return errors.Wrapf(err, "queries[%d]", i)
+		}
+		if !seen[dependency] {
+			return errors.Errorf("queries[%d]: fromQuery %s references unknown query %s", i, *q.FromQuery, dependency)
+		}
+		if err := validateSkippableDependency(named[dependency]); err != nil {
+			return errors.Wrapf(err, "queries[%d]: fromQuery %s", i, *q.FromQuery)
+		}
+		if q.Name == "" {
+			continue
+		}
+		dependencies[q.Name] = dependency
+	}
+
+	for _, q := range in.Queries {
+		name := q.Name
+		if _, ok := dependencies[name]; !ok {
+			continue
+		}
+		chain := []string{name}
+		for next, ok := dependencies[name]; ok; next, ok = dependencies[next] {
+			chain = append(chain, next)
+			if next == name {
+				return errors.Errorf("queries have a dependency cycle: %s", strings.Join(chain, " -> "))
+			}
+			if len(chain) > len(dependencies)+1 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// validateSkippableDependency checks that a query other queries depend on stores its results as
+// queried if it can be skipped, as the queries depending on it then use the data of its first
+// target and must resolve the same values as from fresh results
+func validateSkippableDependency(q v1beta1.Query) error {
+	skippable := (q.SkipQueryWhenTargetHasData != nil && *q.SkipQueryWhenTargetHasData) || q.RefreshInterval != nil
+	if !skippable {
+		return nil
+	}
+
+	var option string
+	targets := resultTargets(&v1beta1.Input{Query: q})
+	switch {
+	case q.Transform != nil && *q.Transform != "",
+		len(targets) > 0 && targets[0].Transform != nil && *targets[0].Transform != "":
+		option = "transform"
+	case q.OutputFormat != nil && *q.OutputFormat != "" && *q.OutputFormat != v1beta1.OutputFormatList:
+		option = "outputFormat " + string(*q.OutputFormat)
+	case useEnvelope(&v1beta1.Input{Query: q}):
+		option = "envelope"
+	case q.MergeStrategy != nil && *q.MergeStrategy != "" && *q.MergeStrategy != v1beta1.MergeStrategyReplace:
+		option = "mergeStrategy " + string(*q.MergeStrategy)
+	default:
+		return nil
+	}
+	return errors.Errorf("query %s can be skipped, so it must store its results as queried, got %s", q.Name, option)
+}
+
+// fromQueryName returns the name of the query a fromQuery path references
+func fromQueryName(fromQuery string) (string, error) {
+	segments, err := parsePath(fromQuery)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid fromQuery")
+	}
+	if segments[0].kind != pathField {
+		return "", errors.Errorf("fromQuery %s must start with the name of a query", fromQuery)
+	}
+	return segments[0].field, nil
+}
+
+// queryName returns the name of the query, defaulting to its position in Input.Queries
+func queryName(q v1beta1.Query, i int) string {
+	if q.Name != "" {
+		return q.Name
+	}
+	return fmt.Sprintf("queries[%d]", i)
+}
+
+// queryInput returns a copy of the input which performs the given query
+func queryInput(in *v1beta1.Input, q v1beta1.Query) *v1beta1.Input {
+	qin := in.DeepCopy()
+	qin.Queries = nil
+	qin.Query = *q.DeepCopy()
+	return qin
+}
+
+// newQueryRuns returns a run per query of the input, linked to the queries they depend on
+func newQueryRuns(in *v1beta1.Input) []*queryRun {
+	runs := make([]*queryRun, 0, len(in.Queries))
+	named := make(map[string]*queryRun, len(in.Queries))
+	for i, q := range in.Queries {
+		run := &queryRun{
+			name: queryName(q, i),
+			in:   queryInput(in, q),
+			rsp:  &fnv1.RunFunctionResponse{},
+		}
+		if q.Name != "" {
+			named[q.Name] = run
+		}
+		runs = append(runs, run)
+	}
+
+	for _, run := range runs {
+		if run.in.FromQuery == nil {
+			continue
+		}
+		// Dependencies were checked by validateQueries
+		if name, err := fromQueryName(*run.in.FromQuery); err == nil {
+			run.dependency = named[name]
+		}
+	}
+	return runs
+}
+
+// executeAndProcessQueries executes the queries of the input, sharing one Graph client,
+// then reports their status and processes their results in order. Queries run concurrently
+// once the queries they depend on are done.
+func (f *Function) executeAndProcessQueries(ctx context.Context, req *fnv1.RunFunctionRequest, in *v1beta1.Input, azureCreds map[string]string, rsp *fnv1.RunFunctionResponse) bool {
+	runs := newQueryRuns(in)
+
+	ctx = withGraphClientCache(ctx)
+	for pending := runs; len(pending) > 0; {
+		var wave, waiting []*queryRun
+		for _, run := range pending {
+			if run.dependency == nil || run.dependency.done {
+				wave = append(wave, run)
+				continue
+			}
+			waiting = append(waiting, run)
+		}
+		if len(wave) == 0 {
+			// This should never happen because validateQueries rejects dependency cycles
+			response.Fatal(rsp, errors.New("queries have a dependency cycle"))
+			return false
+		}
+
+		f.executeQueryWave(ctx, req, wave, azureCreds)
+		pending = waiting
+	}
+
+	// Report the status of each query and process the results in order
+	succeeded := true
+	for _, run := range runs {
+		mergeQueryResponse(rsp, run)
+		switch {
+		case hasFatalResult(run.rsp):
+			succeeded = false
+		case !run.ready:
+			// The query was skipped, keep the data of its targets
+			if err := f.keepSkippedQueryData(req, rsp, run.in); err != nil {
+				response.Fatal(rsp, errors.Wrapf(err, "query %q", run.name))
+				succeeded = false
+			}
+		case f.processResults(req, run.in, run.results, rsp) != nil:
+			succeeded = false
+		default:
+			if err := f.recordQueryTime(req, rsp, run.in); err != nil {
+				response.Fatal(rsp, errors.Wrapf(err, "query %q", run.name))
+				succeeded = false
+			}
+		}
+	}
+	if !succeeded {
+		return false
+	}
+
+	// Check the assertions once the results of every query are stored
+	return f.checkQueryAssertions(req, runs, rsp)
+}
+
+// checkQueryAssertions checks the assertions of the executed queries on their results,
+// applying the strongest failure policy of the queries with failed assertions
+func (f *Function) checkQueryAssertions(req *fnv1.RunFunctionRequest, runs []*queryRun, rsp *fnv1.RunFunctionResponse) bool {
+	var (
+		asserted bool
+		failures []string
+		policy   = v1beta1.AssertionFailurePolicyCondition
+	)
+	for _, run := range runs {
+		if !run.ready || len(run.in.Assertions) == 0 {
+			continue
+		}
+		asserted = true
+
+		runFailures, err := f.evaluateAssertions(req, run.in, run.results)
+		if err != nil {
+			response.Fatal(rsp, errors.Wrapf(err, "query %q", run.name))
+			return false
+		}
+		for _, failure := range runFailures {
+			failures = append(failures, fmt.Sprintf("query %q: %s", run.name, failure))
+		}
+		if len(runFailures) > 0 {
+			policy = strongerAssertionFailurePolicy(policy, getAssertionFailurePolicy(run.in))
+		}
+	}
+	if !asserted {
+		return true
+	}
+	return gateReadiness(rsp, failures, policy)
+}
+
+// executeQueryWave prepares queries whose dependencies are done, then executes them concurrently
+func (f *Function) executeQueryWave(ctx context.Context, req *fnv1.RunFunctionRequest, wave []*queryRun, azureCreds map[string]string) {
+	for _, run := range wave {
+		run.ready = f.prepareQuery(req, run.in, run.rsp)
+		if !run.ready {
+			if !hasFatalResult(run.rsp) {
+				// Queries depending on a skipped query use the data of its target
+				run.results = f.targetData(req, run.in)
+			}
+			continue
+		}
+		if run.dependency != nil {
+			run.ready = f.resolveFromQuery(run)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, run := range wave {
+		if !run.ready {
+			continue
+		}
+		wg.Add(1)
+		go func(run *queryRun) {
+			defer wg.Done()
+			run.results, _ = f.executeInput(ctx, req, run.in, azureCreds, run.rsp) //nolint:errcheck // errors are handled in run.rsp
+		}(run)
+	}
+	wg.Wait()
+
+	for _, run := range wave {
+		run.done = true
+	}
+}
+
+// resolveFromQuery sets the users, groups, group or service principals of a query from the
+// results of the query it depends on. It returns false if they could not be resolved.
+func (f *Function) resolveFromQuery(run *queryRun) bool {
+	fromQuery := *run.in.FromQuery
+	if hasFatalResult(run.dependency.rsp) {
+		response.Fatal(run.rsp, errors.Errorf("fromQuery %s: query %s failed", fromQuery, run.dependency.name))
+		return false
+	}
+
+	results, err := structpb.NewValue(run.dependency.results)
+	if err != nil {
+		response.Fatal(run.rsp, errors.Wrapf(err, "fromQuery %s: cannot convert results of query %s", fromQuery, run.dependency.name))
+		return false
+	}
+	value, err := evaluatePath(map[string]interface{}{run.dependency.in.Query.Name: results.AsInterface()}, fromQuery)
+	if err != nil {
+		response.Fatal(run.rsp, errors.Wrapf(err, "fromQuery %s", fromQuery))
+		return false
+	}
+	values, err := pathStrings(value)
+	if err != nil {
+		response.Fatal(run.rsp, errors.Wrapf(err, "fromQuery %s", fromQuery))
+		return false
+	}
+
+	in := run.in
+	switch in.QueryType {
+	case "UserValidation":
+		in.Users = values
+	case "GroupObjectIDs":
+		in.Groups = values
+	case "ServicePrincipalDetails":
+		in.ServicePrincipals = values
+	case "GroupMembership", "GroupMembershipDrift":
+		if len(values) != 1 {
+			response.Fatal(run.rsp, errors.Errorf("fromQuery %s: %s requires exactly one group, got %d", fromQuery, in.QueryType, len(values)))
+			return false
+		}
+		in.Group = values[0]
+	}
+
+	f.log.Info("Resolved fromQuery", "query", run.name, "fromQuery", fromQuery, "count", len(values))
+	return true
+}
+
+// targetData returns the data already stored in the first target of a query, or nil if there is none.
+// validateSkippableDependency ensures it holds the results as queried.
+func (f *Function) targetData(req *fnv1.RunFunctionRequest, in *v1beta1.Input) interface{} {
+	targets := resultTargets(in)
+	if len(targets) == 0 {
+		return nil
+	}
+	return f.observedTargetData(req, targets[0].Target)
+}
+
+// observedTargetData returns the data stored in a target, or nil if there is none
+func (f *Function) observedTargetData(req *fnv1.RunFunctionRequest, target string) interface{} {
+	var (
+		data  map[string]interface{}
+		field string
+	)
+	switch {
+	case strings.HasPrefix(target, "status."):
+		xrStatus, _, err := f.getXRAndStatus(req)
+		if err != nil {
+			return nil
+		}
+		data, field = xrStatus, strings.TrimPrefix(target, "status.")
+	case strings.HasPrefix(target, "context."):
+		data, field = req.GetContext().AsMap(), strings.TrimPrefix(target, "context.")
+	case strings.HasPrefix(target, "resource."):
+		value, err := observedResourceTargetData(req, target)
+		if err != nil {
+			return nil
+		}
+		return value
+	case strings.HasPrefix(target, "metadata."):
+		value, err := observedMetadataTargetData(req, target)
+		if err != nil || value == "" {
+			return nil
+		}
+		return value
+	default:
+		return nil
+	}
+
+	value, err := evaluatePath(data, field)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// prepareQuery validates a query of Input.Queries and resolves its references.
+// It returns false if the query failed validation or should be skipped.
+func (f *Function) prepareQuery(req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
+	// Check if targets are valid
+	if err := f.validateTargets(in); err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+
+	// Check if transform and output format are valid
+	if err := validateResultOptions(in); err != nil {
+		response.Fatal(rsp, err)
+		return false
+	}
+
+	// Check if we should skip the query
+	if f.shouldSkipQuery(req, in, rsp) {
+		response.Normalf(rsp, "Skipped query, target %s already has data", targetNames(in))
+		return false
+	}
+
+	// Check if the refresh interval has elapsed since the last query
+	if last, pending := f.refreshPending(req, in); pending {
+		response.Normalf(rsp, "Skipped query, last queried at %s, refresh interval %s has not elapsed", last.UTC().Format(time.RFC3339), in.RefreshInterval.Duration)
+		return false
+	}
+
+	// Process references based on query type
+	return f.processReferences(req, in, rsp)
+}
+
+// mergeQueryResponse copies the results and conditions a query reported into the function
+// response, prefixing result messages with the query name
+func mergeQueryResponse(rsp *fnv1.RunFunctionResponse, run *queryRun) {
+	for _, r := range run.rsp.GetResults() {
+		r.Message = fmt.Sprintf("query %q: %s", run.name, r.GetMessage())
+		rsp.Results = append(rsp.Results, r)
+	}
+	for _, c := range run.rsp.GetConditions() {
+		if !hasCondition(rsp, c.GetType()) {
+			rsp.Conditions = append(rsp.Conditions, c)
+		}
+	}
+}
+
+// hasCondition reports whether the response already has a condition of the given type
+func hasCondition(rsp *fnv1.RunFunctionResponse, conditionType string) bool {
+	for _, c := range rsp.GetConditions() {
+		if c.GetType() == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFatalResult reports whether the response has a fatal result
+func hasFatalResult(rsp *fnv1.RunFunctionResponse) bool {
+	for _, r := range rsp.GetResults() {
+		if r.GetSeverity() == fnv1.Severity_SEVERITY_FATAL {
+			return true
+		}
+	}
+	return false
+}
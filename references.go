@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/request"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+const (
+	observedRefPrefix = "observed."
+
+	// refSeparator joins several references into a list reference, e.g. spec.admins + spec.owners
+	refSeparator = " + "
+)
+
+// referenceRoots are the sources of the reference view, by which reference paths start
+var referenceRoots = map[string]bool{
+	"spec":          true,
+	"status":        true,
+	"context":       true,
+	"observed":      true,
+	"desired":       true,
+	"extraResource": true,
+}
+
+// refTemplateFuncs are the functions available in template references
+var refTemplateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"join":  joinValues,
+}
+
+// pendingReferenceError is returned for references to observed composed resources, or fields
+// of them, which do not exist yet, e.g. because the resource is not ready
+type pendingReferenceError struct {
+	error
+}
+
+// isPendingReference reports whether a reference cannot be resolved yet
+func isPendingReference(err error) bool {
+	var pending pendingReferenceError
+	return errors.As(err, &pending)
+}
+
+// handleReferenceError reports a reference which cannot be resolved. The query is skipped
+// while a reference to an observed composed resource cannot be resolved yet, other errors are fatal.
+func (f *Function) handleReferenceError(rsp *fnv1.RunFunctionResponse, err error) {
+	if isPendingReference(err) {
+		f.log.Info("Skipping query until reference can be resolved", "error", err.Error())
+		response.Normalf(rsp, "Skipped query: %s", err)
+		return
+	}
+	response.Fatal(rsp, err)
+}
+
+// queryReferences returns the reference expressions of a query by the name of their field
+func queryReferences(q *v1beta1.Query) map[string]*string {
+	refs := map[string]*string{
+		"groupRef":             q.GroupRef,
+		"groupsRef":            q.GroupsRef,
+		"usersRef":             q.UsersRef,
+		"servicePrincipalsRef": q.ServicePrincipalsRef,
+		"membersRef":           q.MembersRef,
+	}
+	for i, a := range q.Assertions {
+		refs[fmt.Sprintf("assertions[%d].containsRef", i)] = a.ContainsRef
+	}
+	return refs
+}
+
+// referencesObserved reports whether a reference expression resolves values from observed
+// composed resources, which skips the query while they do not exist yet
+func referencesObserved(ref string) bool {
+	for _, part := range refParts(ref) {
+		if strings.HasPrefix(part, observedRefPrefix) || strings.Contains(part, "."+observedRefPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateObservedReferences checks that queries rendering composed resources do not reference
+// observed composed resources: while such a query is skipped, its composed resources would be deleted
+func validateObservedReferences(in *v1beta1.Input) error {
+	if in.ResourceTemplate == nil {
+		return nil
+	}
+	refs := queryReferences(&in.Query)
+	fields := make([]string, 0, len(refs))
+	for field := range refs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if ref := refs[field]; ref != nil && referencesObserved(*ref) {
+			return errors.Errorf("resourceTemplate cannot be combined with references to observed composed resources, got %s %s", field, *ref)
+		}
+	}
+	return nil
+}
+
+// referenceView returns the combined view references are resolved against: the spec and status
+// of the XR, the function context, the observed and desired composed resources by name and the
+// extra resources by name. Extra resources selected with matchName hold the object, those selected
+// with matchLabels always hold the list of objects, so references keep their shape as objects come and go.
+func (f *Function) referenceView(req *fnv1.RunFunctionRequest, in *v1beta1.Input) (map[string]interface{}, error) {
+	// Use getXRAndStatus to ensure spec is copied to desired XR
+	xrStatus, dxr, err := f.getXRAndStatus(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get XR status and desired XR")
+	}
+	xrSpec, _ := dxr.Resource.Object["spec"].(map[string]interface{})
+	if xrSpec == nil {
+		xrSpec = map[string]interface{}{}
+	}
+
+	observed, err := request.GetObservedComposedResources(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get observed composed resources")
+	}
+	observedView := make(map[string]interface{}, len(observed))
+	for name, oc := range observed {
+		if oc.Resource != nil {
+			observedView[string(name)] = oc.Resource.Object
+		}
+	}
+
+	desired, err := request.GetDesiredComposedResources(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get desired composed resources")
+	}
+	desiredView := make(map[string]interface{}, len(desired))
+	for name, dc := range desired {
+		if dc.Resource != nil {
+			desiredView[string(name)] = dc.Resource.Object
+		}
+	}
+
+	extras, err := request.GetExtraResources(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get extra resources")
+	}
+	byName := make(map[string]bool, len(in.ExtraResources))
+	for _, extra := range in.ExtraResources {
+		byName[extra.Name] = extra.MatchName != nil && *extra.MatchName != ""
+	}
+	extraView := make(map[string]interface{}, len(extras))
+	for name, selected := range extras {
+		objects := make([]interface{}, 0, len(selected))
+		for _, extra := range selected {
+			if extra.Resource != nil {
+				objects = append(objects, extra.Resource.Object)
+			}
+		}
+		if byName[name] && len(objects) == 1 {
+			extraView[name] = objects[0]
+			continue
+		}
+		extraView[name] = objects
+	}
+
+	return map[string]interface{}{
+		"spec":          xrSpec,
+		"status":        xrStatus,
+		"context":       req.GetContext().AsMap(),
+		"observed":      observedView,
+		"desired":       desiredView,
+		"extraResource": extraView,
+	}, nil
+}
+
+// refParts splits a reference expression into the references joined with " + "
+func refParts(expr string) []string {
+	parts := strings.Split(expr, refSeparator)
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+// isRefTemplate reports whether a reference is a template such as "{{ .spec.team }}-admins"
+func isRefTemplate(ref string) bool {
+	return strings.Contains(ref, "{{")
+}
+
+// renderRefTemplate renders a template reference against the reference view
+func renderRefTemplate(view map[string]interface{}, ref, refType string) (string, error) {
+	tmpl, err := template.New(refType).Funcs(refTemplateFuncs).Option("missingkey=error").Parse(ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid %s template %s", refType, ref)
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, view); err != nil {
+		err = errors.Wrapf(err, "cannot resolve %s: cannot render %s", refType, ref)
+		if strings.Contains(ref, "."+observedRefPrefix) {
+			return "", pendingReferenceError{err}
+		}
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// joinValues joins the scalar values of a list, e.g. {{ join "," .spec.admins }}
+func joinValues(sep string, values []interface{}) string {
+	joined := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := scalarString(v); ok {
+			joined = append(joined, s)
+			continue
+		}
+		joined = append(joined, fmt.Sprint(v))
+	}
+	return strings.Join(joined, sep)
+}
+
+// checkRefRoot checks that a path reference starts with a source of the reference view and
+// that the composed or extra resource it refers to exists
+func checkRefRoot(view map[string]interface{}, ref, refType string) error {
+	root, rest, _ := strings.Cut(ref, ".")
+	if !referenceRoots[root] || rest == "" {
+		return errors.Errorf("unsupported %s format: %s", refType, ref)
+	}
+
+	resources, ok := view[root].(map[string]interface{})
+	if !ok || root == "spec" || root == "status" || root == "context" {
+		return nil
+	}
+	// The name may be followed by an index or a filter selecting objects of a list
+	name, field := rest, ""
+	if i := strings.IndexAny(rest, ".["); i >= 0 {
+		name, field = rest[:i], strings.TrimPrefix(rest[i:], ".")
+	}
+	if name == "" || field == "" {
+		return errors.Errorf("unsupported %s format: %s", refType, ref)
+	}
+	if _, ok := resources[name]; ok {
+		return nil
+	}
+
+	switch root {
+	case "observed":
+		return pendingReferenceError{errors.Errorf("cannot resolve %s: observed composed resource %s not found", refType, name)}
+	case "desired":
+		return errors.Errorf("cannot resolve %s: desired composed resource %s not found", refType, name)
+	default:
+		return errors.Errorf("cannot resolve %s: extra resource %s not found in extraResources", refType, name)
+	}
+}
+
+// extraResourceList returns the objects and the field path of a reference to an extra resource
+// selecting several or no objects
+func extraResourceList(view map[string]interface{}, ref string) ([]interface{}, string, bool) {
+	rest, ok := strings.CutPrefix(ref, extraResourceRefPrefix)
+	if !ok {
+		return nil, "", false
+	}
+	name, field, _ := strings.Cut(rest, ".")
+	extras, _ := view["extraResource"].(map[string]interface{})
+	objects, ok := extras[name].([]interface{})
+	return objects, field, ok
+}
+
+// resolveRefValue resolves a single-valued reference: a template renders a string, a path
+// resolves to the value it selects. Paths with a wildcard or filter must select exactly one value.
+func resolveRefValue(view map[string]interface{}, ref, refType string) (interface{}, error) {
+	if isRefTemplate(ref) {
+		return renderRefTemplate(view, ref, refType)
+	}
+	if err := checkRefRoot(view, ref, refType); err != nil {
+		return nil, err
+	}
+	if objects, _, ok := extraResourceList(view, ref); ok {
+		if len(objects) == 0 {
+			return nil, errors.Errorf("cannot resolve %s: %s selects no objects", refType, ref)
+		}
+		return nil, errors.Errorf("cannot resolve %s: %s selects a list of %d objects by labels, select one with an index or a filter", refType, ref, len(objects))
+	}
+
+	segments, err := parsePath(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot resolve %s: invalid path", refType)
+	}
+	if selectsMissingField(view, segments) {
+		err := errors.Errorf("cannot resolve %s: %s not found", refType, ref)
+		if strings.HasPrefix(ref, observedRefPrefix) {
+			return nil, pendingReferenceError{err}
+		}
+		return nil, err
+	}
+	value, err := evaluateSegments(view, segments)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot resolve %s: %s", refType, ref)
+	}
+
+	// A wildcard or filter must select exactly one value, e.g. spec.groups[?role==admin].name
+	if list, ok := value.([]interface{}); ok && projects(segments) {
+		if len(list) != 1 {
+			return nil, errors.Errorf("cannot resolve %s: %s selects %d values, expected 1", refType, ref, len(list))
+		}
+		value = list[0]
+	}
+	return value, nil
+}
+
+// resolveRefString resolves a single-valued reference to a string
+func resolveRefString(view map[string]interface{}, ref, refType string) (string, error) {
+	value, err := resolveRefValue(view, ref, refType)
+	if err != nil {
+		return "", err
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", errors.Errorf("cannot resolve %s: %s is %s, not a string", refType, ref, describeValue(value))
+	}
+	return s, nil
+}
+
+// resolveRefStrings resolves a reference of a list reference expression: a template renders a
+// single value, a path must refer to a list of strings. Paths to an extra resource selecting
+// several objects resolve to the values of every object.
+func (f *Function) resolveRefStrings(view map[string]interface{}, ref, refType string) ([]*string, error) {
+	if isRefTemplate(ref) {
+		value, err := renderRefTemplate(view, ref, refType)
+		if err != nil {
+			return nil, err
+		}
+		return []*string{&value}, nil
+	}
+	if err := checkRefRoot(view, ref, refType); err != nil {
+		return nil, err
+	}
+
+	var (
+		values []*string
+		err    error
+	)
+	if objects, field, ok := extraResourceList(view, ref); ok {
+		if len(objects) == 0 {
+			return nil, errors.Errorf("cannot resolve %s: %s selects no objects", refType, ref)
+		}
+		for _, obj := range objects {
+			objMap, _ := obj.(map[string]interface{})
+			var objValues []*string
+			if objValues, err = f.extractStringArrayFromMap(objMap, field, ref, refType); err != nil {
+				return nil, err
+			}
+			values = append(values, objValues...)
+		}
+		return values, nil
+	}
+
+	values, err = f.extractStringArrayFromMap(view, ref, ref, refType)
+	if err != nil && strings.HasPrefix(ref, observedRefPrefix) {
+		if segments, pathErr := parsePath(ref); pathErr == nil && selectsMissingField(view, segments) {
+			return nil, pendingReferenceError{err}
+		}
+	}
+	return values, err
+}
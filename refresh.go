@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// DefaultLastQueryTimeTarget defines the default target storing the time of the last query
+const DefaultLastQueryTimeTarget = "metadata.annotations.msgraph.fn.crossplane.io/last-query-time"
+
+// lastQueryTimeTarget returns the target storing the time of the last query of the input.
+// Named queries default to a target per query, so queries of one input don't share it.
+func lastQueryTimeTarget(in *v1beta1.Input) string {
+	if in.LastQueryTimeTarget != nil && *in.LastQueryTimeTarget != "" {
+		return *in.LastQueryTimeTarget
+	}
+	if in.Query.Name != "" {
+		return DefaultLastQueryTimeTarget + "." + in.Query.Name
+	}
+	return DefaultLastQueryTimeTarget
+}
+
+// validateRefresh checks the refresh interval and the target storing the time of the last query
+func validateRefresh(in *v1beta1.Input) error {
+	if in.RefreshInterval == nil {
+		return nil
+	}
+	if in.RefreshInterval.Duration <= 0 {
+		return errors.Errorf("refreshInterval must be positive, got %s", in.RefreshInterval.Duration)
+	}
+	// The context is not kept between reconciles, so it would be empty until the next query
+	for _, t := range resultTargets(in) {
+		if strings.HasPrefix(t.Target, "context.") {
+			return errors.Errorf("refreshInterval cannot be combined with context targets, got %s", t.Target)
+		}
+	}
+
+	target := lastQueryTimeTarget(in)
+	switch {
+	case strings.HasPrefix(target, "status."):
+		return nil
+	case strings.HasPrefix(target, annotationsTargetPrefix):
+		_, _, err := parseMetadataTarget(target)
+		return errors.Wrap(err, "invalid lastQueryTimeTarget")
+	}
+	return errors.Errorf("lastQueryTimeTarget must be status.<field> or metadata.annotations.<key>, got %s", target)
+}
+
+// lastQueryTime returns the time of the last query stored in the observed XR, if any
+func (f *Function) lastQueryTime(req *fnv1.RunFunctionRequest, in *v1beta1.Input) (time.Time, bool) {
+	value, ok := f.observedTargetData(req, lastQueryTimeTarget(in)).(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// refreshPending returns the time of the last query if the refresh interval has not elapsed since
+func (f *Function) refreshPending(req *fnv1.RunFunctionRequest, in *v1beta1.Input) (time.Time, bool) {
+	if in.RefreshInterval == nil {
+		return time.Time{}, false
+	}
+	last, ok := f.lastQueryTime(req, in)
+	if !ok {
+		return time.Time{}, false
+	}
+	return last, f.now().Before(last.Add(in.RefreshInterval.Duration))
+}
+
+// skipUntilRefresh checks if the query should be skipped because the refresh interval has not
+// elapsed since the last query, keeping the data of its targets if so
+func (f *Function) skipUntilRefresh(req *fnv1.RunFunctionRequest, in *v1beta1.Input, rsp *fnv1.RunFunctionResponse) bool {
+	last, pending := f.refreshPending(req, in)
+	if !pending {
+		return false
+	}
+
+	if err := f.putQueryTime(req, rsp, in, last); err != nil {
+		response.Fatal(rsp, err)
+		return true
+	}
+	if err := f.keepTargetData(req, rsp, in); err != nil {
+		response.Fatal(rsp, err)
+		return true
+	}
+
+	next := last.Add(in.RefreshInterval.Duration)
+	f.log.Info("Refresh interval has not elapsed, skipping query", "lastQueryTime", last, "nextQueryTime", next)
+	response.ConditionTrue(rsp, "FunctionSkip", "RefreshIntervalNotElapsed").
+		WithMessage(fmt.Sprintf("Last queried at %s, next query after %s", last.UTC().Format(time.RFC3339), next.UTC().Format(time.RFC3339))).
+		TargetCompositeAndClaim()
+	return true
+}
+
+// keepTargetData keeps the data of the targets of a skipped query. The XR status is already kept,
+// the data of composed resource and metadata targets is copied from the observed state, as fields
+// left out of the desired state are removed by server-side apply. The context is not kept between
+// reconciles, so context targets stay empty while a query is skipped.
+func (f *Function) keepTargetData(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) error {
+	for _, t := range resultTargets(in) {
+		if !strings.HasPrefix(t.Target, "resource.") && !strings.HasPrefix(t.Target, "metadata.") {
+			continue
+		}
+		// Composed resources no earlier step desires are deleted anyway
+		if strings.HasPrefix(t.Target, "resource.") && !desiredResourceExists(rsp, t.Target) {
+			continue
+		}
+		value := f.observedTargetData(req, t.Target)
+		if value == nil {
+			continue
+		}
+		if err := f.putTargetValue(req, rsp, t.Target, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepSkippedQueryData keeps the data of the targets of a skipped query of Input.Queries and,
+// while its refresh interval has not elapsed, the time of its last query
+func (f *Function) keepSkippedQueryData(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) error {
+	if last, pending := f.refreshPending(req, in); pending {
+		if err := f.putQueryTime(req, rsp, in, last); err != nil {
+			return err
+		}
+	}
+	return f.keepTargetData(req, rsp, in)
+}
+
+// recordQueryTime stores the current time as the time of the last query, if a refresh interval is set
+func (f *Function) recordQueryTime(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input) error {
+	if in.RefreshInterval == nil {
+		return nil
+	}
+	return f.putQueryTime(req, rsp, in, f.now())
+}
+
+// putQueryTime stores the time of the last query in the desired XR
+func (f *Function) putQueryTime(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, in *v1beta1.Input, t time.Time) error {
+	err := f.putTargetValue(req, rsp, lastQueryTimeTarget(in), t.UTC().Format(time.RFC3339))
+	return errors.Wrap(err, "cannot store the time of the last query")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/request"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// parseResourceTarget parses a target such as resource.<name>.spec.forProvider.principalId into
+// the name of a composed resource and the path of the field within it. Paths may contain
+// indexes and [*] wildcards, which fan out list results across the elements of an array.
+func parseResourceTarget(target string) (string, []pathSegment, error) {
+	segments, err := parsePath(strings.TrimPrefix(target, "resource."))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(segments) < 2 || segments[0].kind != pathField {
+		return "", nil, errors.Errorf("invalid target %s: expected resource.<name>.<field>", target)
+	}
+	for _, segment := range segments[1:] {
+		if segment.kind == pathFilter {
+			return "", nil, errors.Errorf("invalid target %s: filters are not supported in targets", target)
+		}
+	}
+	return segments[0].field, segments[1:], nil
+}
+
+// putQueryResultToResource sets a field of a desired composed resource to the query results
+func (f *Function) putQueryResultToResource(rsp *fnv1.RunFunctionResponse, in *v1beta1.Input, results interface{}) error {
+	name, path, err := parseResourceTarget(in.Target)
+	if err != nil {
+		return err
+	}
+
+	// Read the desired composed resources from the response, so results of earlier queries are kept
+	desired, err := request.GetDesiredComposedResources(&fnv1.RunFunctionRequest{Desired: rsp.GetDesired()})
+	if err != nil {
+		return errors.Wrap(err, "cannot get desired composed resources")
+	}
+	dc, ok := desired[resource.Name(name)]
+	if !ok || dc.Resource == nil {
+		return errors.Errorf("cannot set target %s: desired composed resource %s not found", in.Target, name)
+	}
+
+	updated, err := setPathValue(dc.Resource.Object, path, results)
+	if err != nil {
+		return errors.Wrapf(err, "cannot set target %s", in.Target)
+	}
+	obj, ok := updated.(map[string]interface{})
+	if !ok {
+		return errors.Errorf("cannot set target %s: composed resource is not an object", in.Target)
+	}
+	dc.Resource.Object = obj
+
+	f.log.Debug("Updating desired composed resource", "resource", name, "target", in.Target)
+
+	if err := response.SetDesiredComposedResources(rsp, desired); err != nil {
+		return errors.Wrapf(err, "cannot set desired composed resources in %T", rsp)
+	}
+	return nil
+}
+
+// setPathValue sets the value at a path within current, creating missing objects and
+// arrays, and returns the updated value. A [*] wildcard sets the array to one element
+// per element of the value, which must be a list.
+func setPathValue(current interface{}, path []pathSegment, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	segment, rest := path[0], path[1:]
+	switch segment.kind {
+	case pathField:
+		obj, ok := current.(map[string]interface{})
+		if current == nil {
+			obj, ok = map[string]interface{}{}, true
+		}
+		if !ok {
+			return nil, errors.Errorf("cannot set field %s of %s", segment.field, describeValue(current))
+		}
+		v, err := setPathValue(obj[segment.field], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		obj[segment.field] = v
+		return obj, nil
+	case pathIndex:
+		list, ok := current.([]interface{})
+		if current == nil {
+			list, ok = []interface{}{}, true
+		}
+		if !ok {
+			return nil, errors.Errorf("cannot set index [%d] of %s", segment.index, describeValue(current))
+		}
+		for len(list) <= segment.index {
+			list = append(list, nil)
+		}
+		v, err := setPathValue(list[segment.index], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		list[segment.index] = v
+		return list, nil
+	case pathWildcard:
+		values, ok := value.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("cannot fan out %s across [*], expected a list", describeValue(value))
+		}
+		existing, ok := current.([]interface{})
+		if current != nil && !ok {
+			return nil, errors.Errorf("cannot set elements of %s", describeValue(current))
+		}
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			var element interface{}
+			if i < len(existing) {
+				element = existing[i]
+			}
+			updated, err := setPathValue(element, rest, v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "element %d", i)
+			}
+			list[i] = updated
+		}
+		return list, nil
+	}
+	return nil, errors.New("filters are not supported in targets")
+}
+
+// observedResourceTargetData returns the data of a resource target in the observed composed resource
+func observedResourceTargetData(req *fnv1.RunFunctionRequest, target string) (interface{}, error) {
+	name, path, err := parseResourceTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	observed, err := request.GetObservedComposedResources(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get observed composed resources")
+	}
+	oc, ok := observed[resource.Name(name)]
+	if !ok || oc.Resource == nil {
+		return nil, errors.Errorf("observed composed resource %s not found", name)
+	}
+	return evaluateSegments(oc.Resource.Object, path)
+}
+
+// desiredResourceExists reports whether the composed resource of a resource target is desired,
+// by earlier function steps or earlier queries of this step
+func desiredResourceExists(rsp *fnv1.RunFunctionResponse, target string) bool {
+	name, _, err := parseResourceTarget(target)
+	if err != nil {
+		return false
+	}
+	_, ok := rsp.GetDesired().GetResources()[name]
+	return ok
+}
+
+// checkResourceTargetHasData checks if the resource target has data in the observed composed resource.
+func checkResourceTargetHasData(req *fnv1.RunFunctionRequest, target string) bool {
+	value, err := observedResourceTargetData(req, target)
+	return err == nil && valueHasData(value)
+}
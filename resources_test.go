@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestSetPathValue(t *testing.T) {
+	type args struct {
+		current interface{}
+		path    string
+		value   interface{}
+	}
+	type want struct {
+		value interface{}
+		err   error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"CreateFields": {
+			reason: "Missing objects along the path should be created",
+			args: args{
+				current: map[string]interface{}{"spec": map[string]interface{}{"region": "westeurope"}},
+				path:    "spec.forProvider.principalId",
+				value:   "id-1",
+			},
+			want: want{value: map[string]interface{}{"spec": map[string]interface{}{
+				"region":      "westeurope",
+				"forProvider": map[string]interface{}{"principalId": "id-1"},
+			}}},
+		},
+		"Index": {
+			reason: "An index should set the element of an array, growing it if needed",
+			args: args{
+				current: map[string]interface{}{},
+				path:    "members[1]",
+				value:   "id-1",
+			},
+			want: want{value: map[string]interface{}{"members": []interface{}{nil, "id-1"}}},
+		},
+		"FanOut": {
+			reason: "A wildcard should set one array element per result, keeping other fields of existing elements",
+			args: args{
+				current: map[string]interface{}{"members": []interface{}{
+					map[string]interface{}{"role": "Owner"},
+					map[string]interface{}{"role": "Owner"},
+					map[string]interface{}{"role": "Owner"},
+				}},
+				path:  "members[*].principalId",
+				value: []interface{}{"id-1", "id-2"},
+			},
+			want: want{value: map[string]interface{}{"members": []interface{}{
+				map[string]interface{}{"role": "Owner", "principalId": "id-1"},
+				map[string]interface{}{"role": "Owner", "principalId": "id-2"},
+			}}},
+		},
+		"FanOutOfObject": {
+			reason: "A wildcard should require list results",
+			args: args{
+				current: map[string]interface{}{},
+				path:    "members[*].principalId",
+				value:   map[string]interface{}{"id": "id-1"},
+			},
+			want: want{err: errors.New("cannot fan out an object across [*], expected a list")},
+		},
+		"FieldOfString": {
+			reason: "Setting a field of a string should fail",
+			args: args{
+				current: map[string]interface{}{"spec": "invalid"},
+				path:    "spec.forProvider",
+				value:   "id-1",
+			},
+			want: want{err: errors.New("cannot set field forProvider of a string")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path, err := parsePath(tc.args.path)
+			if err != nil {
+				t.Fatalf("parsePath(%s): %v", tc.args.path, err)
+			}
+			value, err := setPathValue(tc.args.current, path, tc.args.value)
+
+			if diff := cmp.Diff(tc.want.value, value); diff != "" {
+				t.Errorf("%s\nsetPathValue(...): -want value, +got value:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nsetPathValue(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestResourceTarget(t *testing.T) {
+	var (
+		xr         = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		assignment = `{
+			"apiVersion": "authorization.azure.upbound.io/v1beta1",
+			"kind": "RoleAssignment",
+			"spec": {"forProvider": {"roleDefinitionName": "Reader"}}
+		}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"SetField": {
+			reason: "The Function should set a field of a desired composed resource",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"transform": "[0].id",
+						"target": "resource.assignment.spec.forProvider.principalId"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(assignment)},
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "authorization.azure.upbound.io/v1beta1",
+								"kind": "RoleAssignment",
+								"spec": {"forProvider": {"roleDefinitionName": "Reader", "principalId": "Developers-id"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"FanOutListResults": {
+			reason: "The Function should fan out list results across an array of a desired composed resource",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Operations", "Developers"],
+						"transform": "[*].id",
+						"target": "resource.assignment.spec.forProvider.principals[*].principalId"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(assignment)},
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "authorization.azure.upbound.io/v1beta1",
+								"kind": "RoleAssignment",
+								"spec": {"forProvider": {
+									"roleDefinitionName": "Reader",
+									"principals": [{"principalId": "Developers-id"}, {"principalId": "Operations-id"}]
+								}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"SkipWhenObservedHasData": {
+			reason: "The Function should skip the query when the observed composed resource already has data",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"transform": "[0].id",
+						"target": "resource.assignment.spec.forProvider.principalId",
+						"skipQueryWhenTargetHasData": true
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "authorization.azure.upbound.io/v1beta1",
+								"kind": "RoleAssignment",
+								"spec": {"forProvider": {"principalId": "existing-id"}}
+							}`)},
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSkip",
+							Status:  fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason:  "SkippedQuery",
+							Message: ptr.To("Target already has data, skipped query to avoid throttling"),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"SkipKeepsObservedData": {
+			reason: "The Function should keep the observed data of a skipped resource target in the desired composed resource",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"transform": "[0].id",
+						"target": "resource.assignment.spec.forProvider.principalId",
+						"skipQueryWhenTargetHasData": true
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "authorization.azure.upbound.io/v1beta1",
+								"kind": "RoleAssignment",
+								"spec": {"forProvider": {"principalId": "existing-id"}}
+							}`)},
+						},
+					},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "authorization.azure.upbound.io/v1beta1",
+								"kind": "RoleAssignment",
+								"spec": {"forProvider": {"roleDefinitionName": "Reader"}}
+							}`)},
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSkip",
+							Status:  fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason:  "SkippedQuery",
+							Message: ptr.To("Target already has data, skipped query to avoid throttling"),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "authorization.azure.upbound.io/v1beta1",
+								"kind": "RoleAssignment",
+								"spec": {"forProvider": {"roleDefinitionName": "Reader", "principalId": "existing-id"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"SkipKeepsObservedDataInQueries": {
+			reason: "The Function should keep the observed data of the resource target of a skipped query of queries",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queries": [
+							{
+								"name": "developers",
+								"queryType": "GroupObjectIDs",
+								"groups": ["Developers"],
+								"transform": "[0].id",
+								"target": "resource.assignment.spec.forProvider.principalId",
+								"skipQueryWhenTargetHasData": true
+							}
+						]
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "authorization.azure.upbound.io/v1beta1",
+								"kind": "RoleAssignment",
+								"spec": {"forProvider": {"principalId": "existing-id"}}
+							}`)},
+						},
+					},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "authorization.azure.upbound.io/v1beta1",
+								"kind": "RoleAssignment",
+								"spec": {"forProvider": {"roleDefinitionName": "Reader"}}
+							}`)},
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:    "FunctionSkip",
+							Status:  fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason:  "SkippedQuery",
+							Message: ptr.To("Target already has data, skipped query to avoid throttling"),
+							Target:  fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `query "developers": Skipped query, target resource.assignment.spec.forProvider.principalId already has data`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "authorization.azure.upbound.io/v1beta1",
+								"kind": "RoleAssignment",
+								"spec": {"forProvider": {"roleDefinitionName": "Reader", "principalId": "existing-id"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"ResourceNotFound": {
+			reason: "The Function should fail when the desired composed resource does not exist",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "resource.missing.spec.forProvider.principals"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "cannot set target resource.missing.spec.forProvider.principals: desired composed resource missing not found",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"InvalidResourceTarget": {
+			reason: "The Function should refuse a resource target without a field",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["Developers"],
+						"target": "resource.assignment"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "Unrecognized target field: resource.assignment",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
+					results := make([]interface{}, 0, len(in.Groups))
+					for _, group := range in.Groups {
+						results = append(results, map[string]interface{}{
+							"id":          *group + "-id",
+							"displayName": *group,
+						})
+					}
+					return results, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// shapeResults converts query results to JSON values, sorts them and applies the
+// transform and output format of the input, in that order
+func shapeResults(in *v1beta1.Input, results interface{}) (interface{}, error) {
+	value, err := structpb.NewValue(results)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert results data to structpb.Value")
+	}
+
+	sorted, err := sortResults(in, value.AsInterface())
+	if err != nil {
+		return nil, err
+	}
+
+	shaped, err := transformResults(in, sorted)
+	if err != nil {
+		return nil, err
+	}
+	return formatResults(in, shaped)
+}
+
+// applyPerTenant applies fn to the results. The results of tenant fan-out queries
+// are a map keyed by tenant name, fn is applied to the results of each tenant.
+func applyPerTenant(in *v1beta1.Input, results interface{}, fn func(interface{}) (interface{}, error)) (interface{}, error) {
+	if len(in.Tenants) == 0 {
+		return fn(results)
+	}
+
+	tenants, ok := results.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("expected results per tenant")
+	}
+	names := make([]string, 0, len(tenants))
+	for tenant := range tenants {
+		names = append(names, tenant)
+	}
+	sort.Strings(names)
+
+	applied := make(map[string]interface{}, len(tenants))
+	for _, tenant := range names {
+		tenantResults, err := fn(tenants[tenant])
+		if err != nil {
+			return nil, errors.Wrapf(err, "tenant %s", tenant)
+		}
+		applied[tenant] = tenantResults
+	}
+	return applied, nil
+}
+
+// validateResultOptions checks the options of the input shaping and checking the query results
+func validateResultOptions(in *v1beta1.Input) error {
+	if _, err := parseSortBy(in); err != nil {
+		return err
+	}
+	if err := validateTransform(in); err != nil {
+		return err
+	}
+	if err := validateOutputFormat(in); err != nil {
+		return err
+	}
+	return validateAssertions(in)
+}
+
+// parseSortBy parses the path the results of the input are sorted by, defaulting to id
+func parseSortBy(in *v1beta1.Input) ([]pathSegment, error) {
+	sortBy := DefaultSortBy
+	if in.SortBy != nil && *in.SortBy != "" {
+		sortBy = *in.SortBy
+	}
+	path, err := parsePath(trimRootPath(sortBy))
+	return path, errors.Wrapf(err, "invalid sortBy %s", sortBy)
+}
+
+// sortResults sorts lists of JSON query results by the sort key of the input. Results
+// without the sort key are sorted last, and results with equal sort keys are sorted
+// by their JSON encoding, so that the order of the results never depends on the order
+// Microsoft Graph returned them in.
+func sortResults(in *v1beta1.Input, results interface{}) (interface{}, error) {
+	sortBy, err := parseSortBy(in)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyPerTenant(in, results, func(results interface{}) (interface{}, error) {
+		list, ok := results.([]interface{})
+		if !ok {
+			return results, nil
+		}
+
+		type sortable struct {
+			element interface{}
+			hasKey  bool
+			key     string
+			encoded string
+		}
+		elements := make([]sortable, 0, len(list))
+		for _, element := range list {
+			s := sortable{element: element}
+			if key, err := evaluateSegments(element, sortBy); err == nil && key != nil {
+				s.hasKey, s.key = true, sortKeyString(key)
+			}
+			encoded, err := json.Marshal(element)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot encode result")
+			}
+			s.encoded = string(encoded)
+			elements = append(elements, s)
+		}
+
+		sort.SliceStable(elements, func(i, j int) bool {
+			a, b := elements[i], elements[j]
+			switch {
+			case a.hasKey != b.hasKey:
+				return a.hasKey
+			case a.key != b.key:
+				return a.key < b.key
+			}
+			return a.encoded < b.encoded
+		})
+
+		sorted := make([]interface{}, 0, len(elements))
+		for _, s := range elements {
+			sorted = append(sorted, s.element)
+		}
+		return sorted, nil
+	})
+}
+
+// sortKeyString returns the string a result is sorted by
+func sortKeyString(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Sprint(key)
+	}
+	return string(encoded)
+}
+
+// validateOutputFormat checks that the output format of the input, if any, is supported
+func validateOutputFormat(in *v1beta1.Input) error {
+	if in.OutputFormat == nil {
+		return nil
+	}
+	switch *in.OutputFormat {
+	case "", v1beta1.OutputFormatList, v1beta1.OutputFormatMapByName, v1beta1.OutputFormatMapByID:
+		return nil
+	}
+	return errors.Errorf("unsupported outputFormat: %s", *in.OutputFormat)
+}
+
+// nameKey returns the field holding the name a result was queried by
+func nameKey(queryType string) string {
+	if queryType == "UserValidation" {
+		return "userPrincipalName"
+	}
+	return "displayName"
+}
+
+// formatResults applies the output format of the input to JSON query results
+func formatResults(in *v1beta1.Input, results interface{}) (interface{}, error) {
+	if in.OutputFormat == nil {
+		return results, nil
+	}
+
+	var key string
+	switch *in.OutputFormat {
+	case v1beta1.OutputFormatMapByName:
+		key = nameKey(in.QueryType)
+	case v1beta1.OutputFormatMapByID:
+		key = "id"
+	default:
+		return results, nil
+	}
+
+	formatted, err := applyPerTenant(in, results, func(results interface{}) (interface{}, error) {
+		mapped, err := mapResultsByKey(results, key)
+		if err != nil {
+			return nil, err
+		}
+		return mapped, nil
+	})
+	return formatted, errors.Wrapf(err, "cannot apply outputFormat %s", *in.OutputFormat)
+}
+
+// mapResultsByKey converts a list of results to a map keyed by the given field of each result.
+// Results sharing a key are refused rather than overwriting each other.
+func mapResultsByKey(results interface{}, key string) (map[string]interface{}, error) {
+	list, ok := results.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("expected a list of results, got %s", describeValue(results))
+	}
+
+	mapped := make(map[string]interface{}, len(list))
+	for i, element := range list {
+		obj, ok := element.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("result %d is %s, not an object", i, describeValue(element))
+		}
+		k, ok := obj[key].(string)
+		if !ok || k == "" {
+			return nil, errors.Errorf("result %d has no %s", i, key)
+		}
+		if _, exists := mapped[k]; exists {
+			if key == "id" {
+				return nil, errors.Errorf("results have duplicate id %s", k)
+			}
+			// Display names are not unique in Microsoft Graph
+			return nil, errors.Errorf("results have duplicate %s %s, use outputFormat mapById to key results by object ID", key, k)
+		}
+		mapped[k] = obj
+	}
+	return mapped, nil
+}
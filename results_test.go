@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestFormatResults(t *testing.T) {
+	groups := []interface{}{
+		map[string]interface{}{"id": "id-1", "displayName": "platform-admins"},
+		map[string]interface{}{"id": "id-2", "displayName": "developers"},
+	}
+
+	type args struct {
+		in      *v1beta1.Input
+		results interface{}
+	}
+	type want struct {
+		results interface{}
+		err     error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"List": {
+			reason: "The list output format should store results unchanged",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{QueryType: "GroupObjectIDs", OutputFormat: ptr.To(v1beta1.OutputFormatList)}},
+				results: groups,
+			},
+			want: want{results: groups},
+		},
+		"MapByName": {
+			reason: "The mapByName output format should key group results by display name",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{QueryType: "GroupObjectIDs", OutputFormat: ptr.To(v1beta1.OutputFormatMapByName)}},
+				results: groups,
+			},
+			want: want{results: map[string]interface{}{
+				"platform-admins": groups[0],
+				"developers":      groups[1],
+			}},
+		},
+		"MapUsersByName": {
+			reason: "The mapByName output format should key user results by user principal name",
+			args: args{
+				in: &v1beta1.Input{Query: v1beta1.Query{QueryType: "UserValidation", OutputFormat: ptr.To(v1beta1.OutputFormatMapByName)}},
+				results: []interface{}{
+					map[string]interface{}{"id": "user-id", "displayName": "User", "userPrincipalName": "user@example.com"},
+				},
+			},
+			want: want{results: map[string]interface{}{
+				"user@example.com": map[string]interface{}{"id": "user-id", "displayName": "User", "userPrincipalName": "user@example.com"},
+			}},
+		},
+		"MapByIDPerTenant": {
+			reason: "The mapById output format should key results of each tenant by object ID",
+			args: args{
+				in: &v1beta1.Input{
+					Query:   v1beta1.Query{QueryType: "GroupObjectIDs", OutputFormat: ptr.To(v1beta1.OutputFormatMapByID)},
+					Tenants: []v1beta1.Tenant{{Name: "home"}},
+				},
+				results: map[string]interface{}{"home": groups[:1]},
+			},
+			want: want{results: map[string]interface{}{
+				"home": map[string]interface{}{"id-1": groups[0]},
+			}},
+		},
+		"DuplicateName": {
+			reason: "The mapByName output format should fail when results share a name",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{QueryType: "GroupObjectIDs", OutputFormat: ptr.To(v1beta1.OutputFormatMapByName)}},
+				results: []interface{}{groups[0], groups[0]},
+			},
+			want: want{err: errors.Wrap(errors.New("results have duplicate displayName platform-admins, use outputFormat mapById to key results by object ID"), "cannot apply outputFormat mapByName")},
+		},
+		"TransformedResults": {
+			reason: "Map output formats should fail for results which are not objects",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{QueryType: "GroupObjectIDs", OutputFormat: ptr.To(v1beta1.OutputFormatMapByID)}},
+				results: []interface{}{"id-1"},
+			},
+			want: want{err: errors.Wrap(errors.New("result 0 is a string, not an object"), "cannot apply outputFormat mapById")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			results, err := formatResults(tc.args.in, tc.args.results)
+
+			if diff := cmp.Diff(tc.want.results, results); diff != "" {
+				t.Errorf("%s\nformatResults(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nformatResults(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	var (
+		xr    = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"MapByNameInStatus": {
+			reason: "The Function should store results in the status keyed by the queried names",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["platform-admins", "developers"],
+						"outputFormat": "mapByName",
+						"target": "status.groups"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"count": 2},
+								"status": {
+									"groups": {
+										"platform-admins": {"id": "platform-admins-id", "displayName": "platform-admins"},
+										"developers": {"id": "developers-id", "displayName": "developers"}
+									}
+								}}`),
+						},
+					},
+				},
+			},
+		},
+		"MapByIDInContext": {
+			reason: "The Function should store results in the context keyed by object ID",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["developers"],
+						"outputFormat": "mapById",
+						"target": "context.groups"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupObjectIDs"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"groups": {
+							"developers-id": {"id": "developers-id", "displayName": "developers"}
+						}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"UnsupportedOutputFormat": {
+			reason: "The Function should refuse an unsupported output format before running the query",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupObjectIDs",
+						"groups": ["developers"],
+						"outputFormat": "mapByColor",
+						"target": "status.groups"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "unsupported outputFormat: mapByColor",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
+					results := make([]interface{}, 0, len(in.Groups))
+					for _, group := range in.Groups {
+						results = append(results, map[string]interface{}{
+							"id":          *group + "-id",
+							"displayName": *group,
+						})
+					}
+					return results, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestSortResults(t *testing.T) {
+	type args struct {
+		in      *v1beta1.Input
+		results interface{}
+	}
+	type want struct {
+		results interface{}
+		err     error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"SortByID": {
+			reason: "Results should be sorted by id by default",
+			args: args{
+				in: &v1beta1.Input{},
+				results: []interface{}{
+					map[string]interface{}{"id": "b"},
+					map[string]interface{}{"id": "c"},
+					map[string]interface{}{"id": "a"},
+				},
+			},
+			want: want{results: []interface{}{
+				map[string]interface{}{"id": "a"},
+				map[string]interface{}{"id": "b"},
+				map[string]interface{}{"id": "c"},
+			}},
+		},
+		"SortByConfiguredKey": {
+			reason: "Results should be sorted by the configured key, then by their encoding",
+			args: args{
+				in: &v1beta1.Input{Query: v1beta1.Query{SortBy: ptr.To("displayName")}},
+				results: []interface{}{
+					map[string]interface{}{"id": "3", "displayName": "Ops"},
+					map[string]interface{}{"id": "2", "displayName": "Dev"},
+					map[string]interface{}{"id": "1", "displayName": "Ops"},
+				},
+			},
+			want: want{results: []interface{}{
+				map[string]interface{}{"id": "2", "displayName": "Dev"},
+				map[string]interface{}{"id": "1", "displayName": "Ops"},
+				map[string]interface{}{"id": "3", "displayName": "Ops"},
+			}},
+		},
+		"MissingKeyLast": {
+			reason: "Results without the sort key should be sorted last",
+			args: args{
+				in: &v1beta1.Input{},
+				results: []interface{}{
+					map[string]interface{}{"displayName": "No ID"},
+					map[string]interface{}{"id": "a"},
+				},
+			},
+			want: want{results: []interface{}{
+				map[string]interface{}{"id": "a"},
+				map[string]interface{}{"displayName": "No ID"},
+			}},
+		},
+		"Strings": {
+			reason: "Lists of strings should be sorted by value",
+			args: args{
+				in:      &v1beta1.Input{},
+				results: []interface{}{"b", "a"},
+			},
+			want: want{results: []interface{}{"a", "b"}},
+		},
+		"PerTenant": {
+			reason: "Results of tenant fan-out queries should be sorted per tenant",
+			args: args{
+				in: &v1beta1.Input{Tenants: []v1beta1.Tenant{{Name: "home"}}},
+				results: map[string]interface{}{"home": []interface{}{
+					map[string]interface{}{"id": "b"},
+					map[string]interface{}{"id": "a"},
+				}},
+			},
+			want: want{results: map[string]interface{}{"home": []interface{}{
+				map[string]interface{}{"id": "a"},
+				map[string]interface{}{"id": "b"},
+			}}},
+		},
+		"InvalidSortBy": {
+			reason: "An invalid sort key should return an error",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{SortBy: ptr.To("members[")}},
+				results: []interface{}{},
+			},
+			want: want{err: errors.Wrap(errors.New("invalid path members[: unterminated ["), "invalid sortBy members[")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			results, err := sortResults(tc.args.in, tc.args.results)
+
+			if diff := cmp.Diff(tc.want.results, results); diff != "" {
+				t.Errorf("%s\nsortResults(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\nsortResults(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+// permutations returns every permutation of the given results
+func permutations(results []interface{}) [][]interface{} {
+	if len(results) <= 1 {
+		return [][]interface{}{results}
+	}
+	var all [][]interface{}
+	for i := range results {
+		rest := make([]interface{}, 0, len(results)-1)
+		rest = append(rest, results[:i]...)
+		rest = append(rest, results[i+1:]...)
+		for _, p := range permutations(rest) {
+			all = append(all, append([]interface{}{results[i]}, p...))
+		}
+	}
+	return all
+}
+
+func TestSortedOutputIsDeterministic(t *testing.T) {
+	members := []interface{}{
+		map[string]interface{}{"id": "user-id-2", "type": "user", "displayName": "User"},
+		map[string]interface{}{"id": "user-id-1", "type": "user", "displayName": "User"},
+		map[string]interface{}{"id": "sp-id-1", "type": "servicePrincipal", "displayName": "App"},
+		map[string]interface{}{"type": "unknown", "displayName": "Unknown 2"},
+		map[string]interface{}{"type": "unknown", "displayName": "Unknown 1"},
+	}
+
+	cases := map[string]struct {
+		reason string
+		input  string
+	}{
+		"SortByIDInStatus": {
+			reason: "Results stored in the status should not depend on the order Graph returned them in",
+			input: `{
+				"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+				"kind": "Input",
+				"queryType": "GroupMembership",
+				"group": "Developers",
+				"target": "status.members"
+			}`,
+		},
+		"SortByDisplayNameInContext": {
+			reason: "Results sorted by a key with duplicates should not depend on the order Graph returned them in",
+			input: `{
+				"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+				"kind": "Input",
+				"queryType": "GroupMembership",
+				"group": "Developers",
+				"sortBy": "displayName",
+				"target": "context.members"
+			}`,
+		},
+		"Transform": {
+			reason: "Transformed results should not depend on the order Graph returned them in",
+			input: `{
+				"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+				"kind": "Input",
+				"queryType": "GroupMembership",
+				"group": "Developers",
+				"transform": "[?type==user].id",
+				"target": "status.userIDs"
+			}`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var (
+				first    []byte
+				firstOut *fnv1.RunFunctionResponse
+			)
+			for i, permutation := range permutations(members) {
+				f := &Function{
+					graphQuery: &MockGraphQuery{
+						GraphQueryFunc: func(_ context.Context, _ map[string]string, _ *v1beta1.Input) (interface{}, error) {
+							return permutation, nil
+						},
+					},
+					log: logging.NewNopLogger(),
+				}
+				rsp, err := f.RunFunction(context.Background(), &fnv1.RunFunctionRequest{
+					Input: resource.MustStructJSON(tc.input),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"}}`),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: &fnv1.CredentialData{
+								Data: map[string][]byte{
+									"credentials": []byte(`{"clientId": "id", "clientSecret": "secret", "tenantId": "tenant"}`),
+								},
+							}},
+						},
+					},
+				})
+				if err != nil {
+					t.Fatalf("%s\nf.RunFunction(...): unexpected error: %v", tc.reason, err)
+				}
+
+				out := &fnv1.RunFunctionResponse{Desired: rsp.GetDesired(), Context: rsp.GetContext()}
+				got, err := proto.MarshalOptions{Deterministic: true}.Marshal(out)
+				if err != nil {
+					t.Fatalf("%s\nproto.Marshal(...): unexpected error: %v", tc.reason, err)
+				}
+
+				if i == 0 {
+					first, firstOut = got, out
+					continue
+				}
+				if !bytes.Equal(first, got) {
+					t.Fatalf("%s\npermutation %d: -want output, +got output:\n%s", tc.reason, i, cmp.Diff(firstOut, out, protocmp.Transform()))
+				}
+			}
+		})
+	}
+}
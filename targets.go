@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// resultTargets returns the targets the query results are stored in: the target of the
+// input, if any, followed by its additional targets
+func resultTargets(in *v1beta1.Input) []v1beta1.ResultTarget {
+	targets := make([]v1beta1.ResultTarget, 0, len(in.Targets)+1)
+	if in.Target != "" {
+		targets = append(targets, v1beta1.ResultTarget{Target: in.Target})
+	}
+	return append(targets, in.Targets...)
+}
+
+// resultTargetField returns the input field of the i-th target returned by resultTargets,
+// for use in messages
+func resultTargetField(in *v1beta1.Input, i int) string {
+	if in.Target == "" {
+		return fmt.Sprintf("targets[%d]", i)
+	}
+	if i == 0 {
+		return "target"
+	}
+	return fmt.Sprintf("targets[%d]", i-1)
+}
+
+// targetNames returns the comma-separated targets of the input, for use in messages
+func targetNames(in *v1beta1.Input) string {
+	targets := resultTargets(in)
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		names = append(names, t.Target)
+	}
+	return strings.Join(names, ", ")
+}
+
+// validateTargets checks that the input has at least one target or a resource template, that
+// every target, per-target transform and the resource template are valid and that the merge
+// strategy, envelope, refresh and drift detection options suit the targets
+func (f *Function) validateTargets(in *v1beta1.Input) error {
+	targets := resultTargets(in)
+	if len(targets) == 0 && in.ResourceTemplate == nil {
+		return errors.Errorf("Unrecognized target field: %s", in.Target)
+	}
+	for i, t := range targets {
+		if !f.isValidTarget(t.Target) {
+			return errors.Errorf("Unrecognized target field: %s", t.Target)
+		}
+		if t.Transform == nil {
+			continue
+		}
+		if err := validateTransform(&v1beta1.Input{Query: v1beta1.Query{Transform: t.Transform}}); err != nil {
+			return errors.Wrap(err, resultTargetField(in, i))
+		}
+	}
+	if err := validateMergeStrategy(in); err != nil {
+		return err
+	}
+	if err := validateEnvelope(in); err != nil {
+		return err
+	}
+	if err := validateRefresh(in); err != nil {
+		return err
+	}
+	if err := validateResourceTemplate(in); err != nil {
+		return err
+	}
+	return f.validateDriftDetection(in)
+}
+
+// targetInput returns a copy of the input storing results in the given target, with the
+// transform of the target replacing the transform of the input
+func targetInput(in *v1beta1.Input, t v1beta1.ResultTarget) *v1beta1.Input {
+	tin := *in
+	tin.Target = t.Target
+	tin.Targets = nil
+	if t.Transform != nil {
+		tin.Transform = t.Transform
+	}
+	return &tin
+}
+
+// processResults stores the query results in each target of the input, reporting drift
+// from the data in the first target if enabled, and renders the resource template, if any
+func (f *Function) processResults(req *fnv1.RunFunctionRequest, in *v1beta1.Input, results interface{}, rsp *fnv1.RunFunctionResponse) error {
+	targets := resultTargets(in)
+	if in.DriftDetection != nil && len(targets) > 0 {
+		if err := f.detectDrift(req, rsp, targetInput(in, targets[0]), results); err != nil {
+			response.Fatal(rsp, err)
+			return err
+		}
+	}
+
+	for _, t := range targets {
+		if err := f.processTargetResults(req, targetInput(in, t), results, rsp); err != nil {
+			return err
+		}
+	}
+
+	if in.ResourceTemplate != nil {
+		if err := f.renderResources(rsp, in, results); err != nil {
+			response.Fatal(rsp, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// putTargetValue stores a value as is in a target, without shaping, merging or wrapping it
+func (f *Function) putTargetValue(req *fnv1.RunFunctionRequest, rsp *fnv1.RunFunctionResponse, target string, value interface{}) error {
+	in := &v1beta1.Input{Query: v1beta1.Query{Target: target}}
+	switch {
+	case strings.HasPrefix(target, "status."):
+		return f.putQueryResultToStatus(req, rsp, in, value)
+	case strings.HasPrefix(target, "context."):
+		return putQueryResultToContext(req, rsp, in, value, f)
+	case strings.HasPrefix(target, "resource."):
+		return f.putQueryResultToResource(rsp, in, value)
+	case strings.HasPrefix(target, "metadata."):
+		return f.putQueryResultToMetadata(req, rsp, in, value)
+	}
+	return errors.Errorf("Unrecognized target field: %s", target)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/request"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/resource/composed"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// DefaultNameFromField is the field of each result composed resource names are built from
+const DefaultNameFromField = "id"
+
+// invalidNameCharacters matches the characters replaced in composed resource names
+var invalidNameCharacters = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// resourcePatch is a parsed Input.ResourceTemplate patch
+type resourcePatch struct {
+	from []pathSegment
+	to   []pathSegment
+}
+
+// resourceTemplate is a parsed Input.ResourceTemplate
+type resourceTemplate struct {
+	namePrefix    string
+	nameFromField []pathSegment
+	base          map[string]interface{}
+	patches       []resourcePatch
+}
+
+// parseResourceTemplate parses the resource template of the input
+func parseResourceTemplate(t *v1beta1.ResourceTemplate) (*resourceTemplate, error) {
+	if t.NamePrefix == "" {
+		return nil, errors.New("resourceTemplate.namePrefix is required")
+	}
+
+	nameFromField := DefaultNameFromField
+	if t.NameFromField != nil && *t.NameFromField != "" {
+		nameFromField = *t.NameFromField
+	}
+	namePath, err := parsePath(trimRootPath(nameFromField))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid resourceTemplate.nameFromField %s", nameFromField)
+	}
+
+	base := map[string]interface{}{}
+	if err := json.Unmarshal(t.Base.Raw, &base); err != nil {
+		return nil, errors.Wrap(err, "cannot parse resourceTemplate.base")
+	}
+	if base["apiVersion"] == nil || base["kind"] == nil {
+		return nil, errors.New("resourceTemplate.base must set apiVersion and kind")
+	}
+
+	patches := make([]resourcePatch, 0, len(t.Patches))
+	for i, p := range t.Patches {
+		from, err := parsePath(trimRootPath(p.FromFieldPath))
+		if err != nil {
+			return nil, errors.Wrapf(err, "resourceTemplate.patches[%d]: invalid fromFieldPath %s", i, p.FromFieldPath)
+		}
+		to, err := parsePath(p.ToFieldPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resourceTemplate.patches[%d]: invalid toFieldPath %s", i, p.ToFieldPath)
+		}
+		if len(to) == 0 || to[0].kind != pathField {
+			return nil, errors.Errorf("resourceTemplate.patches[%d]: invalid toFieldPath %s: expected a field", i, p.ToFieldPath)
+		}
+		for _, segment := range to {
+			if segment.kind == pathFilter {
+				return nil, errors.Errorf("resourceTemplate.patches[%d]: invalid toFieldPath %s: filters are not supported", i, p.ToFieldPath)
+			}
+		}
+		patches = append(patches, resourcePatch{from: from, to: to})
+	}
+
+	return &resourceTemplate{namePrefix: t.NamePrefix, nameFromField: namePath, base: base, patches: patches}, nil
+}
+
+// validateResourceTemplate checks the resource template of the input. Composed resources must be
+// rendered on every run, or Crossplane deletes them, so queries with a resource template are never skipped.
+func validateResourceTemplate(in *v1beta1.Input) error {
+	if in.ResourceTemplate == nil {
+		return nil
+	}
+	if _, err := parseResourceTemplate(in.ResourceTemplate); err != nil {
+		return err
+	}
+	if in.SkipQueryWhenTargetHasData != nil && *in.SkipQueryWhenTargetHasData {
+		return errors.New("resourceTemplate cannot be combined with skipQueryWhenTargetHasData")
+	}
+	if in.RefreshInterval != nil {
+		return errors.New("resourceTemplate cannot be combined with refreshInterval")
+	}
+	return validateObservedReferences(in)
+}
+
+// renderResources renders the resource template of the input for each query result, after
+// sortBy and transform are applied, and adds the rendered resources to the desired composed resources
+func (f *Function) renderResources(rsp *fnv1.RunFunctionResponse, in *v1beta1.Input, results interface{}) error {
+	t, err := parseResourceTemplate(in.ResourceTemplate)
+	if err != nil {
+		return err
+	}
+
+	value, err := structpb.NewValue(results)
+	if err != nil {
+		return errors.Wrap(err, "cannot convert results data to structpb.Value")
+	}
+	sorted, err := sortResults(in, value.AsInterface())
+	if err != nil {
+		return err
+	}
+	shaped, err := transformResults(in, sorted)
+	if err != nil {
+		return err
+	}
+	list, ok := shaped.([]interface{})
+	if !ok {
+		return errors.Errorf("resourceTemplate requires a list of results, got %s", describeValue(shaped))
+	}
+
+	// Read the desired composed resources from the response, so resources of earlier queries are kept
+	desired, err := request.GetDesiredComposedResources(&fnv1.RunFunctionRequest{Desired: rsp.GetDesired()})
+	if err != nil {
+		return errors.Wrap(err, "cannot get desired composed resources")
+	}
+
+	rendered := make(map[resource.Name]bool, len(list))
+	for i, element := range list {
+		name, err := t.resourceName(element)
+		if err != nil {
+			return errors.Wrapf(err, "cannot render resourceTemplate for result %d", i)
+		}
+		if rendered[name] {
+			return errors.Errorf("cannot render resourceTemplate for result %d: duplicate composed resource name %s", i, name)
+		}
+		rendered[name] = true
+
+		obj, err := t.render(element)
+		if err != nil {
+			return errors.Wrapf(err, "cannot render resourceTemplate for result %d", i)
+		}
+		dc := composed.New()
+		dc.Object = obj
+		desired[name] = &resource.DesiredComposed{Resource: dc}
+	}
+
+	f.log.Debug("Rendered composed resources", "namePrefix", t.namePrefix, "count", len(rendered))
+
+	if err := response.SetDesiredComposedResources(rsp, desired); err != nil {
+		return errors.Wrapf(err, "cannot set desired composed resources in %T", rsp)
+	}
+	return nil
+}
+
+// resourceName returns the name of the composed resource rendered for a result, built from
+// the name prefix and the lower-cased name field of the result
+func (t *resourceTemplate) resourceName(element interface{}) (resource.Name, error) {
+	value, err := evaluateSegments(element, t.nameFromField)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get name")
+	}
+	s, ok := scalarString(value)
+	if !ok {
+		return "", errors.Errorf("name is %s, not a string", describeValue(value))
+	}
+	name := strings.Trim(invalidNameCharacters.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if name == "" {
+		return "", errors.Errorf("invalid name %q", s)
+	}
+	return resource.Name(t.namePrefix + "-" + name), nil
+}
+
+// render returns a copy of the base with the patches applied from a result
+func (t *resourceTemplate) render(element interface{}) (map[string]interface{}, error) {
+	value, err := structpb.NewValue(t.base)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot copy resourceTemplate.base")
+	}
+	var obj interface{} = value.AsInterface()
+
+	for i, p := range t.patches {
+		from, err := evaluateSegments(element, p.from)
+		if err != nil || from == nil {
+			continue
+		}
+		if obj, err = setPathValue(obj, p.to, from); err != nil {
+			return nil, errors.Wrapf(err, "patches[%d]", i)
+		}
+	}
+	rendered, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("rendered composed resource is not an object")
+	}
+	return rendered, nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestResourceTemplate(t *testing.T) {
+	var (
+		xr         = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		assignment = `{
+			"apiVersion": "authorization.azure.upbound.io/v1beta1",
+			"kind": "RoleAssignment",
+			"spec": {"forProvider": {"roleDefinitionName": "Reader"}}
+		}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"ResourcePerResult": {
+			reason: "The Function should render a composed resource per result, named by object ID, keeping other desired resources",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"resourceTemplate": {
+							"namePrefix": "member",
+							"base": {
+								"apiVersion": "groups.azuread.upbound.io/v1beta1",
+								"kind": "Member",
+								"spec": {"forProvider": {"groupObjectId": "platform-admins-id"}}
+							},
+							"patches": [
+								{"fromFieldPath": "id", "toFieldPath": "spec.forProvider.memberObjectId"},
+								{"fromFieldPath": "userPrincipalName", "toFieldPath": "metadata.annotations[example.org/user]"}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(assignment)},
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupMembership"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+						Resources: map[string]*fnv1.Resource{
+							"assignment": {Resource: resource.MustStructJSON(assignment)},
+							"member-alice-id": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "groups.azuread.upbound.io/v1beta1",
+								"kind": "Member",
+								"metadata": {"annotations": {"example.org/user": "alice@example.com"}},
+								"spec": {"forProvider": {"groupObjectId": "platform-admins-id", "memberObjectId": "alice-id"}}
+							}`)},
+							"member-bob-id": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "groups.azuread.upbound.io/v1beta1",
+								"kind": "Member",
+								"metadata": {"annotations": {"example.org/user": "bob@example.com"}},
+								"spec": {"forProvider": {"groupObjectId": "platform-admins-id", "memberObjectId": "bob-id"}}
+							}`)},
+							"member-deployer-id": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "groups.azuread.upbound.io/v1beta1",
+								"kind": "Member",
+								"spec": {"forProvider": {"groupObjectId": "platform-admins-id", "memberObjectId": "Deployer-ID"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"TransformAndNameFromField": {
+			reason: "The Function should render resources for the transformed results, named by the nameFromField of each result",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"transform": "[?type==user]",
+						"target": "status.members",
+						"resourceTemplate": {
+							"namePrefix": "member",
+							"nameFromField": "userPrincipalName",
+							"base": {
+								"apiVersion": "groups.azuread.upbound.io/v1beta1",
+								"kind": "Member"
+							},
+							"patches": [
+								{"fromFieldPath": "id", "toFieldPath": "spec.forProvider.memberObjectId"}
+							]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupMembership"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "XR",
+								"metadata": {"name": "cool-xr"},
+								"spec": {"count": 2},
+								"status": {
+									"members": [
+										{"id": "alice-id", "type": "user", "userPrincipalName": "alice@example.com"},
+										{"id": "bob-id", "type": "user", "userPrincipalName": "bob@example.com"}
+									]
+								}
+							}`),
+						},
+						Resources: map[string]*fnv1.Resource{
+							"member-alice-example-com": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "groups.azuread.upbound.io/v1beta1",
+								"kind": "Member",
+								"spec": {"forProvider": {"memberObjectId": "alice-id"}}
+							}`)},
+							"member-bob-example-com": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "groups.azuread.upbound.io/v1beta1",
+								"kind": "Member",
+								"spec": {"forProvider": {"memberObjectId": "bob-id"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"MissingKind": {
+			reason: "The Function should refuse a resource template without apiVersion and kind",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"resourceTemplate": {
+							"namePrefix": "member",
+							"base": {"spec": {}}
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "resourceTemplate.base must set apiVersion and kind",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"SkipQueryWhenTargetHasData": {
+			reason: "The Function should refuse to skip queries rendering composed resources, as skipped resources would be deleted",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"target": "status.members",
+						"skipQueryWhenTargetHasData": true,
+						"resourceTemplate": {
+							"namePrefix": "member",
+							"base": {"apiVersion": "groups.azuread.upbound.io/v1beta1", "kind": "Member"}
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "resourceTemplate cannot be combined with skipQueryWhenTargetHasData",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"DuplicateName": {
+			reason: "The Function should fail when two results render the same composed resource name",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "GroupMembership",
+						"group": "platform-admins",
+						"resourceTemplate": {
+							"namePrefix": "member",
+							"nameFromField": "type",
+							"base": {"apiVersion": "groups.azuread.upbound.io/v1beta1", "kind": "Member"}
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "GroupMembership"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "cannot render resourceTemplate for result 2: duplicate composed resource name member-user",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, _ *v1beta1.Input) (interface{}, error) {
+					return []interface{}{
+						map[string]interface{}{"id": "Deployer-ID", "displayName": "Deployer", "type": "servicePrincipal"},
+						map[string]interface{}{"id": "alice-id", "userPrincipalName": "alice@example.com", "type": "user"},
+						map[string]interface{}{"id": "bob-id", "userPrincipalName": "bob@example.com", "type": "user"},
+					}, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/upbound/function-msgraph/input/v1beta1"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// resultTransform is a parsed Input.Transform expression
+type resultTransform struct {
+	// path projects the results, e.g. [*].id
+	path []pathSegment
+
+	// keyPath and valuePath build a map from a list of results, e.g. {userPrincipalName: id}
+	keyPath   []pathSegment
+	valuePath []pathSegment
+}
+
+// parseTransform parses a transform expression. Expressions are either a path such as
+// [*].id or $.value, or a map expression such as {userPrincipalName: id} whose key and
+// value are paths evaluated against every element of the results.
+func parseTransform(expr string) (*resultTransform, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "{") {
+		if !strings.HasSuffix(expr, "}") {
+			return nil, errors.Errorf("invalid transform %s: unterminated {", expr)
+		}
+		key, value, found := strings.Cut(expr[1:len(expr)-1], ":")
+		if !found {
+			return nil, errors.Errorf("invalid transform %s: expected {key: value}", expr)
+		}
+		keyPath, err := parsePath(trimRootPath(key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid transform %s", expr)
+		}
+		valuePath, err := parsePath(trimRootPath(value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid transform %s", expr)
+		}
+		return &resultTransform{keyPath: keyPath, valuePath: valuePath}, nil
+	}
+
+	path, err := parsePath(trimRootPath(expr))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid transform %s", expr)
+	}
+	return &resultTransform{path: path}, nil
+}
+
+// trimRootPath removes the optional $ or @ root of a path
+func trimRootPath(path string) string {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "$")
+	path = strings.TrimPrefix(path, "@")
+	return path
+}
+
+// apply applies the transform to results. Map expressions refuse results sharing a key, as
+// mapResultsByKey does, rather than overwriting them.
+func (t *resultTransform) apply(results interface{}) (interface{}, error) {
+	if t.path != nil {
+		return evaluateSegments(results, t.path)
+	}
+
+	list, ok := results.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("cannot build a map from %s, expected a list", describeValue(results))
+	}
+	mapped := make(map[string]interface{}, len(list))
+	for i, element := range list {
+		key, err := evaluateSegments(element, t.keyPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "element %d: cannot get key", i)
+		}
+		keyString, ok := key.(string)
+		if !ok {
+			return nil, errors.Errorf("element %d: key is %s, not a string", i, describeValue(key))
+		}
+		if _, exists := mapped[keyString]; exists {
+			return nil, errors.Errorf("element %d: duplicate key %s", i, keyString)
+		}
+		value, err := evaluateSegments(element, t.valuePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "element %d: cannot get value", i)
+		}
+		mapped[keyString] = value
+	}
+	return mapped, nil
+}
+
+// validateTransform checks that the transform of the input, if any, can be parsed
+func validateTransform(in *v1beta1.Input) error {
+	if in.Transform == nil || *in.Transform == "" {
+		return nil
+	}
+	_, err := parseTransform(*in.Transform)
+	return err
+}
+
+// transformResults applies the transform of the input to JSON query results
+func transformResults(in *v1beta1.Input, results interface{}) (interface{}, error) {
+	if in.Transform == nil || *in.Transform == "" {
+		return results, nil
+	}
+
+	t, err := parseTransform(*in.Transform)
+	if err != nil {
+		return nil, err
+	}
+
+	transformed, err := applyPerTenant(in, results, t.apply)
+	return transformed, errors.Wrapf(err, "cannot apply transform %s", *in.Transform)
+}
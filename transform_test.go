@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/upbound/function-msgraph/input/v1beta1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/utils/ptr"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+	"github.com/crossplane/crossplane-runtime/pkg/test"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+func TestTransformResults(t *testing.T) {
+	users := []interface{}{
+		map[string]interface{}{"id": "id-1", "userPrincipalName": "one@example.com"},
+		map[string]interface{}{"id": "id-2", "userPrincipalName": "two@example.com"},
+	}
+
+	type args struct {
+		in      *v1beta1.Input
+		results interface{}
+	}
+	type want struct {
+		results interface{}
+		err     error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"NoTransform": {
+			reason: "Results should be returned unchanged without a transform",
+			args: args{
+				in:      &v1beta1.Input{},
+				results: users,
+			},
+			want: want{results: users},
+		},
+		"Projection": {
+			reason: "A path transform should project the results",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{Transform: ptr.To("[*].id")}},
+				results: users,
+			},
+			want: want{results: []interface{}{"id-1", "id-2"}},
+		},
+		"RootedProjection": {
+			reason: "A path transform may start with $",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{Transform: ptr.To("$[1].userPrincipalName")}},
+				results: users,
+			},
+			want: want{results: "two@example.com"},
+		},
+		"Map": {
+			reason: "A map transform should build a map from the results",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{Transform: ptr.To("{userPrincipalName: id}")}},
+				results: users,
+			},
+			want: want{results: map[string]interface{}{
+				"one@example.com": "id-1",
+				"two@example.com": "id-2",
+			}},
+		},
+		"PerTenant": {
+			reason: "Results of tenant fan-out queries should be transformed per tenant",
+			args: args{
+				in: &v1beta1.Input{
+					Query:   v1beta1.Query{Transform: ptr.To("[*].id")},
+					Tenants: []v1beta1.Tenant{{Name: "home"}, {Name: "resource"}},
+				},
+				results: map[string]interface{}{"home": users, "resource": users[:1]},
+			},
+			want: want{results: map[string]interface{}{
+				"home":     []interface{}{"id-1", "id-2"},
+				"resource": []interface{}{"id-1"},
+			}},
+		},
+		"MapOfObject": {
+			reason: "A map transform should fail for results which are not a list",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{Transform: ptr.To("{userPrincipalName: id}")}},
+				results: map[string]interface{}{"id": "id-1"},
+			},
+			want: want{err: errors.Wrap(errors.New("cannot build a map from an object, expected a list"), "cannot apply transform {userPrincipalName: id}")},
+		},
+		"NonStringKey": {
+			reason: "A map transform should fail for keys which are not strings",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{Transform: ptr.To("{id: userPrincipalName}")}},
+				results: []interface{}{map[string]interface{}{"id": float64(1), "userPrincipalName": "one@example.com"}},
+			},
+			want: want{err: errors.Wrap(errors.New("element 0: key is a number, not a string"), "cannot apply transform {id: userPrincipalName}")},
+		},
+		"DuplicateKey": {
+			reason: "A map transform should fail for results sharing a key",
+			args: args{
+				in:      &v1beta1.Input{Query: v1beta1.Query{Transform: ptr.To("{userPrincipalName: id}")}},
+				results: []interface{}{users[0], users[0]},
+			},
+			want: want{err: errors.Wrap(errors.New("element 1: duplicate key one@example.com"), "cannot apply transform {userPrincipalName: id}")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			results, err := transformResults(tc.args.in, tc.args.results)
+
+			if diff := cmp.Diff(tc.want.results, results); diff != "" {
+				t.Errorf("%s\ntransformResults(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, test.EquateErrors()); diff != "" {
+				t.Errorf("%s\ntransformResults(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestTransform(t *testing.T) {
+	var (
+		xr    = `{"apiVersion":"example.org/v1","kind":"XR","metadata":{"name":"cool-xr"},"spec":{"count":2}}`
+		creds = &fnv1.CredentialData{
+			Data: map[string][]byte{
+				"credentials": []byte(`{
+"clientId": "test-client-id",
+"clientSecret": "test-client-secret",
+"tenantId": "test-tenant-id"
+}`),
+			},
+		}
+	)
+
+	type args struct {
+		ctx context.Context
+		req *fnv1.RunFunctionRequest
+	}
+	type want struct {
+		rsp *fnv1.RunFunctionResponse
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"TransformToMap": {
+			reason: "The Function should store the transformed results in the target",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "UserValidation",
+						"users": ["user@example.com"],
+						"transform": "{userPrincipalName: id}",
+						"target": "context.userIDs"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Conditions: []*fnv1.Condition{
+						{
+							Type:   "FunctionSuccess",
+							Status: fnv1.Status_STATUS_CONDITION_TRUE,
+							Reason: "Success",
+							Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  `QueryType: "UserValidation"`,
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Context: resource.MustStructJSON(`{
+						"userIDs": {"user@example.com": "user-id"}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+		"InvalidTransform": {
+			reason: "The Function should refuse an invalid transform before running the query",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "msgraph.fn.crossplane.io/v1alpha1",
+						"kind": "Input",
+						"queryType": "UserValidation",
+						"users": ["user@example.com"],
+						"transform": "[*.id",
+						"target": "status.validatedUsers"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+					Credentials: map[string]*fnv1.Credentials{
+						"azure-creds": {
+							Source: &fnv1.Credentials_CredentialData{CredentialData: creds},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_FATAL,
+							Message:  "invalid transform [*.id: invalid path [*.id: unterminated [",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{
+							Resource: resource.MustStructJSON(xr),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mockQuery := &MockGraphQuery{
+				GraphQueryFunc: func(_ context.Context, _ map[string]string, in *v1beta1.Input) (interface{}, error) {
+					results := make([]interface{}, 0, len(in.Users))
+					for _, user := range in.Users {
+						results = append(results, map[string]interface{}{
+							"id":                "user-id",
+							"userPrincipalName": *user,
+						})
+					}
+					return results, nil
+				},
+			}
+
+			f := &Function{
+				graphQuery: mockQuery,
+				log:        logging.NewNopLogger(),
+			}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}